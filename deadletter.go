@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	"github.com/octoblu/governator/deployer"
+)
+
+func deadLetterCommand() cli.Command {
+	return cli.Command{
+		Name:  "deadletter",
+		Usage: "List, inspect and requeue deploys that ran out of attempts",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the dead lettered deploys, oldest first",
+				Action: listDeadLetters,
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Print every field of a deploy",
+				ArgsUsage: "<deploy>",
+				Action:    inspectDeadLetter,
+			},
+			{
+				Name:      "requeue",
+				Usage:     "Put a dead lettered deploy back on the queue, due right away",
+				ArgsUsage: "<deploy>",
+				Action:    requeueDeadLetter,
+			},
+		},
+	}
+}
+
+func listDeadLetters(context *cli.Context) error {
+	deploys, err := getRedisQueue(context).DeadLetters()
+	if err != nil {
+		return err
+	}
+
+	for _, deploy := range deploys {
+		fmt.Println(deploy)
+	}
+	return nil
+}
+
+func inspectDeadLetter(context *cli.Context) error {
+	fields, err := getRedisQueue(context).InspectDeploy(getDeployArg(context))
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields["request:metadata"] = deployer.RedactRequestMetadata(fields["request:metadata"])
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, fields[name])
+	}
+	return nil
+}
+
+func requeueDeadLetter(context *cli.Context) error {
+	deploy := getDeployArg(context)
+	err := getRedisQueue(context).RequeueDeadLetter(deploy)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("requeued %s\n", deploy)
+	return nil
+}
+
+func getDeployArg(context *cli.Context) string {
+	deploy := context.Args().First()
+	if deploy == "" {
+		cli.ShowCommandHelp(context, context.Command.Name)
+		color.Red("  Missing required argument <deploy>")
+		os.Exit(1)
+	}
+	return deploy
+}
+
+// getRedisQueue builds the queue for the commands
+// that only look at the queue and never touch etcd
+func getRedisQueue(context *cli.Context) *deployer.RedisQueue {
+	redisURI := context.GlobalString("redis-uri")
+	redisQueue := context.GlobalString("redis-queue")
+
+	if redisURI == "" || redisQueue == "" {
+		cli.ShowAppHelp(context)
+
+		if redisURI == "" {
+			color.Red("  Missing required flag --redis-uri or GOVERNATOR_REDIS_URI")
+		}
+		if redisQueue == "" {
+			color.Red("  Missing required flag --redis-queue or GOVERNATOR_REDIS_QUEUE")
+		}
+		os.Exit(1)
+	}
+
+	redisCluster := context.GlobalBool("redis-cluster")
+	redisPool := getRedisPool(redisURI, redisQueue, redisCluster)
+	return deployer.NewRedisQueue(redisPool, redisQueue, &deployer.QueueOptions{HashTag: redisCluster})
+}
@@ -0,0 +1,49 @@
+package deployer
+
+import "fmt"
+
+// skipReason tells why a claimed deploy should not be applied, it is empty
+// when the deploy should go ahead. A deploy that already succeeded is
+// skipped, so is one overtaken by a newer release of its etcdDir, even
+// with env changes, and one whose etcdDir already runs its docker url, going
+// by the first key of its layout, unless it forces a restart or carries env
+// changes. A deploy that was started before is never skipped for its docker
+// url, that may have been written by the earlier attempt
+func (deployer *Deployer) skipReason(claim *Claim) (string, error) {
+	applied, err := deployer.queue.Applied(claim.Deploy)
+	if err != nil {
+		return "", err
+	}
+
+	if applied == StatusDone {
+		return "already applied", nil
+	}
+
+	newer, err := deployer.newerRelease(claim)
+	if err != nil {
+		return "", err
+	}
+
+	if newer != nil {
+		return fmt.Sprintf("%v was due later and went out already", newer.Deploy), nil
+	}
+
+	if applied != "" || claim.Metadata.ForceRestart || claim.Metadata.hasEnvChanges() {
+		return "", nil
+	}
+
+	keys, err := deployer.renderKeys(claim)
+	if err != nil {
+		return "", err
+	}
+
+	dockerURL, err := deployer.etcdClient.Get(keys[0].key)
+	if err != nil {
+		return "", err
+	}
+
+	if dockerURL == keys[0].value {
+		return fmt.Sprintf("%v is already %v", keys[0].step, dockerURL), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,28 @@
+package deployer
+
+import "fmt"
+
+// cancelledError stops a deploy that was cancelled while in flight,
+// after is the last step that was carried out
+type cancelledError struct {
+	deploy string
+	after  string
+}
+
+func (err *cancelledError) Error() string {
+	return fmt.Sprintf("Deploy '%v' was cancelled after %v", err.deploy, err.after)
+}
+
+// checkCancelled returns a cancelledError when a cancellation
+// landed for the deploy since the step named after
+func (deployer *Deployer) checkCancelled(deploy, after string) error {
+	cancelled, err := deployer.queue.IsCancelled(deploy)
+	if err != nil {
+		return err
+	}
+
+	if cancelled {
+		return &cancelledError{deploy: deploy, after: after}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// claimScript takes the first due deploy off the queue, records it as skipped
+// if it was cancelled and otherwise moves it in flight as claimed, all in one
+// atomic step. The statuses match StatusSkipped and StatusClaimed.
+// Urgent deploys go first, unless a normal deploy has been due since before
+// the starvation deadline. The lane a deploy came from is kept in its hash.
+// The score it was first claimed at is kept as due:at, retries and holds
+// reschedule it, and goes back along with the metadata and whether an
+// earlier attempt restarted the service
+//
+// KEYS[1] deploys zset, KEYS[2] in flight zset, KEYS[3] urgent deploys zset
+// ARGV[1] now, ARGV[2] lease deadline, ARGV[3] instance id, ARGV[4] deploy key prefix,
+// ARGV[5] starvation deadline
+var claimScript = redis.NewScript(3, `
+local deploy, lane, dueAt
+local normal = redis.call('ZRANGEBYSCORE', KEYS[1], 0, ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1)
+if normal[1] and tonumber(normal[2]) <= tonumber(ARGV[5]) then
+  deploy, lane, dueAt = normal[1], 'normal', normal[2]
+else
+  local urgent = redis.call('ZRANGEBYSCORE', KEYS[3], 0, ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1)
+  if urgent[1] then
+    deploy, lane, dueAt = urgent[1], 'urgent', urgent[2]
+  else
+    deploy, lane, dueAt = normal[1], 'normal', normal[2]
+  end
+end
+
+if not deploy then
+  return false
+end
+
+if lane == 'urgent' then
+  redis.call('ZREM', KEYS[3], deploy)
+else
+  redis.call('ZREM', KEYS[1], deploy)
+end
+
+local deployKey = ARGV[4] .. deploy
+if redis.call('HEXISTS', deployKey, 'cancellation') == 1 then
+  redis.call('HMSET', deployKey, 'status', 'skipped', 'finished:at', ARGV[1])
+  return {deploy, 'cancelled'}
+end
+
+local metadata = redis.call('HGET', deployKey, 'request:metadata')
+if not metadata then
+  return {deploy, 'missing'}
+end
+
+redis.call('ZADD', KEYS[2], ARGV[2], deploy)
+redis.call('HMSET', deployKey, 'status', 'claimed', 'claimed:by', ARGV[3], 'claimed:at', ARGV[1], 'lane', lane)
+redis.call('HSETNX', deployKey, 'due:at', dueAt)
+dueAt = redis.call('HGET', deployKey, 'due:at')
+local restarted = redis.call('HGET', deployKey, 'restarted:at') or ''
+return {deploy, 'claimed', metadata, dueAt, restarted}
+`)
+
+// Claim takes the first due deploy off the queue and puts it in flight
+func (queue *RedisQueue) Claim() (*Claim, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	now := queue.clock.Now()
+	deadline := now.Add(queue.leaseDuration)
+
+	reply, err := redis.Strings(claimScript.Do(
+		redisConn,
+		queue.getKey("governator:deploys"),
+		queue.getKey("governator:inflight"),
+		queue.getKey("governator:deploys:urgent"),
+		now.Unix(),
+		deadline.Unix(),
+		queue.instanceID,
+		queue.getKey(""),
+		now.Add(-queue.maxNormalDelay).Unix(),
+	))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deploy, state := reply[0], reply[1]
+	switch state {
+	case "cancelled":
+		debug("Deploy was cancelled: %v", deploy)
+		return &Claim{Deploy: deploy, Cancelled: true}, queue.expire(redisConn, deploy)
+	case "missing":
+		return nil, fmt.Errorf("Deploy metadata not found for '%v'", deploy)
+	}
+
+	debug("claimed: %v", deploy)
+	var metadata RequestMetadata
+	err = json.Unmarshal([]byte(reply[2]), &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	dueAt, err := parseScore(reply[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Claim{Deploy: deploy, Metadata: &metadata, DueAt: dueAt, Restarted: reply[4] != ""}, nil
+}
+
+// parseScore turns the zset score of a deploy into the time it is due at
+func parseScore(score string) (time.Time, error) {
+	seconds, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(seconds), 0), nil
+}
@@ -0,0 +1,45 @@
+package deployer
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells a queue what time it is
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the clock of the machine governator runs on
+type SystemClock struct{}
+
+// Now returns the local time
+func (clock SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock only moves when it is told to,
+// which makes it possible to drive a queue through time
+type ManualClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+// NewManualClock constructs a clock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time the clock is stopped at
+func (clock *ManualClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+// Advance moves the clock forward
+func (clock *ManualClock) Advance(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(duration)
+}
@@ -0,0 +1,45 @@
+package deployer
+
+import "time"
+
+// Counts returns how many deploys this deployer finished with each
+// status, failed attempts are counted under StatusRetrying
+func (deployer *Deployer) Counts() map[string]int {
+	deployer.countsMutex.Lock()
+	defer deployer.countsMutex.Unlock()
+
+	counts := make(map[string]int, len(deployer.counts))
+	for status, count := range deployer.counts {
+		counts[status] = count
+	}
+	return counts
+}
+
+// ack acks a deploy on the queue and counts its status
+func (deployer *Deployer) ack(deploy, status string, fields ...string) error {
+	err := deployer.queue.Ack(deploy, status, fields...)
+	if err != nil {
+		return err
+	}
+
+	deployer.count(status)
+	return nil
+}
+
+// fail fails a deploy on the queue and counts the attempt
+func (deployer *Deployer) fail(deploy string, cause error) (time.Time, error) {
+	retryAt, err := deployer.queue.Fail(deploy, cause)
+	if err != nil {
+		return retryAt, err
+	}
+
+	deployer.count(StatusRetrying)
+	return retryAt, nil
+}
+
+func (deployer *Deployer) count(status string) {
+	deployer.countsMutex.Lock()
+	defer deployer.countsMutex.Unlock()
+
+	deployer.counts[status]++
+}
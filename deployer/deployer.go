@@ -1,195 +1,293 @@
 package deployer
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/garyburd/redigo/redis"
 	De "github.com/tj/go-debug"
 )
 
 var debug = De.Debug("governator:deployer")
 
-// Deployer watches a redis queue
+// Deployer takes deploys off a queue
 // and deploys services using Etcd
 type Deployer struct {
 	etcdClient     EtcdClient
-	redisConn      redis.Conn
-	queueName      string
+	queue          Queue
 	deployStateUri string
 	cluster        string
+	workers        int
+	supersede      bool
+	clock          Clock
+	maxLateness    time.Duration
+	schedule       *Schedule
+	keyLayouts     *KeyLayouts
+	verification   *Verification
+	leaseDuration  time.Duration
+	counts         map[string]int
+	countsMutex    sync.Mutex
+	paused         bool
+	pauseReason    string
+	pauseMutex     sync.Mutex
+}
+
+// Options are the optional settings of a deployer,
+// zero values are replaced with the defaults
+type Options struct {
+	// Workers is how many services are deployed in parallel. When above one,
+	// every due deploy is claimed on each Run
+	Workers int
+
+	// Supersede claims every due deploy on each Run and only deploys the
+	// newest one per etcdDir, the older ones are marked superseded
+	Supersede bool
+
+	// Clock tells the deployer when the next deploy is due,
+	// it should be the clock of the queue
+	Clock Clock
+
+	// MaxLateness is how long after it was due a deploy is still rolled out,
+	// later it expires. Zero lets deploys be as late as they get
+	MaxLateness time.Duration
+
+	// Schedule holds deploys that come due outside of it back until it
+	// allows them, unless they are emergencies. Nil allows any time
+	Schedule *Schedule
+
+	// KeyLayouts picks the keys written per deploy,
+	// nil writes the DefaultKeyLayout everywhere
+	KeyLayouts *KeyLayouts
+
+	// Verification waits for the service to report healthy before the
+	// deploy is reported passed, nil reports it right after the restart
+	Verification *Verification
+
+	// LeaseDuration should be the lease of the queue, a deploy waiting to
+	// be verified renews its lease three times per lease. Its timeout has
+	// to be shorter than the lease
+	LeaseDuration time.Duration
 }
 
 // RequestMetadata is the metadata of the request
 type RequestMetadata struct {
 	EtcdDir   string `json:"etcdDir"`
 	DockerURL string `json:"dockerUrl"`
+
+	// ForceRestart deploys even when docker_url already is DockerURL
+	ForceRestart bool `json:"forceRestart,omitempty"`
+
+	// Deadline is the unix time after which the deploy expires
+	// instead of being rolled out, zero for no deadline
+	Deadline int64 `json:"deadline,omitempty"`
+
+	// Emergency deploys go out regardless of the schedule
+	Emergency bool `json:"emergency,omitempty"`
+
+	// Type is empty for a deploy of DockerURL, or RequestTypeRollback
+	// to roll EtcdDir back to an earlier release, see FindRollbackTarget
+	Type string `json:"type,omitempty"`
+
+	// RollbackTo names the release a rollback goes back to,
+	// empty for the one before the current release
+	RollbackTo string `json:"rollbackTo,omitempty"`
+
+	// Env is written under <etcdDir>/env/ and UnsetEnv removed from it,
+	// in the same deploy before the service restarts. The values are
+	// secrets as far as governator is concerned, see Redacted
+	Env      map[string]string `json:"env,omitempty"`
+	UnsetEnv []string          `json:"unsetEnv,omitempty"`
 }
 
-// New constructs a new deployer instance
-func New(etcdClient EtcdClient, redisConn redis.Conn, queueName, deployStateUri, cluster string) *Deployer {
+// New constructs a new deployer instance, options may be nil
+func New(etcdClient EtcdClient, queue Queue, deployStateUri, cluster string, options *Options) *Deployer {
+	if options == nil {
+		options = &Options{}
+	}
+
 	return &Deployer{
 		etcdClient:     etcdClient,
-		redisConn:      redisConn,
-		queueName:      queueName,
+		queue:          queue,
 		deployStateUri: deployStateUri,
 		cluster:        cluster,
+		workers:        options.getWorkers(),
+		supersede:      options.Supersede,
+		clock:          options.getClock(),
+		maxLateness:    options.MaxLateness,
+		schedule:       options.Schedule,
+		keyLayouts:     options.KeyLayouts,
+		verification:   options.Verification,
+		leaseDuration:  options.getLeaseDuration(),
+		counts:         make(map[string]int),
 	}
 }
 
-// Run watches the redis queue and starts taking action
+// Run takes the next due deploy off the queue and deploys it,
+// unless the queue or the etcdDir of the deploy is paused
+// or the schedule does not allow it
 func (deployer *Deployer) Run() error {
-	deploy, err := deployer.getNextValidDeploy()
-	if err != nil {
+	paused, err := deployer.checkPaused()
+	if err != nil || paused {
 		return err
 	}
 
-	if deploy == nil {
-		return nil
+	if deployer.workers > 1 || deployer.supersede {
+		return deployer.runWorkers()
 	}
 
-	return deployer.deploy(deploy)
-}
-
-func (deployer *Deployer) getReleaseVersion(dockerURL string) string {
-	parts := strings.Split(dockerURL, ":")
-	return parts[len(parts)-1]
-}
-
-func (deployer *Deployer) getKey(key string) string {
-	return fmt.Sprintf("%s:%s", deployer.queueName, key)
-}
-
-func (deployer *Deployer) deploy(metadata *RequestMetadata) error {
-	var err error
-	dockerURLKey := fmt.Sprintf("%v/docker_url", metadata.EtcdDir)
-	err = deployer.etcdClient.Set(dockerURLKey, metadata.DockerURL)
+	claim, err := deployer.queue.Claim()
 	if err != nil {
 		return err
 	}
 
-	releaseKey := fmt.Sprintf("%v/env/SENTRY_RELEASE", metadata.EtcdDir)
-	err = deployer.etcdClient.Set(releaseKey, deployer.getReleaseVersion(metadata.DockerURL))
-	if err != nil {
-		return err
+	if claim == nil || claim.Cancelled {
+		return nil
 	}
 
-	restartValue := fmt.Sprintf("%v", time.Now())
-	restartKey := fmt.Sprintf("%v/restart", metadata.EtcdDir)
-	err = deployer.etcdClient.Set(restartKey, restartValue)
+	groups, err := deployer.holdPausedGroups([][]*Claim{{claim}})
+	if err == nil {
+		groups, err = deployer.holdUnscheduled(groups)
+	}
 	if err != nil {
-		return err
+		return deployer.releaseGroups(groups, err)
 	}
 
-	err = deployer.notifyDeployState(metadata.DockerURL)
-	if err != nil {
-		return err
+	if len(groups) == 0 {
+		return nil
 	}
 
-	return nil
+	return deployer.deploySerially(groups[0])
 }
 
-func (deployer *Deployer) getNextDeploy() (string, error) {
-	now := time.Now().Unix()
-	deploysResult, err := deployer.redisConn.Do("ZRANGEBYSCORE", deployer.getKey("governator:deploys"), 0, now)
+// NextDeployIn returns how long until the earliest scheduled deploy is due,
+// zero if one is due already, and never more than maxWait. While the
+// queue is paused it returns when to look whether it was resumed
+func (deployer *Deployer) NextDeployIn(maxWait time.Duration) (time.Duration, error) {
+	if paused, _ := deployer.Paused(); paused {
+		if pauseCheckInterval < maxWait {
+			return pauseCheckInterval, nil
+		}
+		return maxWait, nil
+	}
 
+	deploy, dueAt, err := deployer.queue.NextDue()
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
-	deploys := deploysResult.([]interface{})
-	if len(deploys) == 0 {
-		return "", nil
+	if deploy == "" {
+		return maxWait, nil
 	}
 
-	return string(deploys[0].([]byte)), nil
-}
-
-func (deployer *Deployer) lockDeploy(deploy string) (bool, error) {
-	debug("lockDeploy: %v", deploy)
-	zremResult, err := deployer.redisConn.Do("ZREM", deployer.getKey("governator:deploys"), deploy)
-
-	if err != nil {
-		return false, err
+	wait := dueAt.Sub(deployer.clock.Now())
+	if wait < 0 {
+		return 0, nil
 	}
-
-	result := zremResult.(int64)
-
-	return (result != 0), nil
-}
-
-func (deployer *Deployer) validateDeploy(deploy string) (bool, error) {
-	debug("validateDeploy: %v", deploy)
-	existsResult, err := deployer.redisConn.Do("HEXISTS", deployer.getKey(deploy), "cancellation")
-
-	if err != nil {
-		return false, err
+	if wait > maxWait {
+		return maxWait, nil
 	}
-
-	exists := existsResult.(int64)
-	return (exists == 0), nil
+	return wait, nil
 }
 
-func (deployer *Deployer) getMetadata(deploy string) (*RequestMetadata, error) {
-	debug("getMetadata: %v", deploy)
-	var metadata RequestMetadata
+func (deployer *Deployer) getReleaseVersion(dockerURL string) string {
+	parts := strings.Split(dockerURL, ":")
+	return parts[len(parts)-1]
+}
 
-	metadataBytes, err := deployer.redisConn.Do("HGET", deployer.getKey(deploy), "request:metadata")
-	if err != nil {
-		return nil, err
+// deploy writes the keys of a claimed deploy to etcd, the env changes it
+// carries go before the last key, which restarts the service. A deploy
+// that restarted the service on an earlier attempt is only reported
+func (deployer *Deployer) deploy(claim *Claim) error {
+	metadata := claim.Metadata
+	if claim.Restarted {
+		debug("deploy: %v restarted the service already, reporting it", claim.Deploy)
+		return deployer.finish(claim, EtcdValue{})
 	}
 
-	if metadataBytes == nil {
-		return nil, fmt.Errorf("Deploy metadata not found for '%v'", deploy)
+	err := deployer.checkCancelled(claim.Deploy, "claim")
+	if err != nil {
+		return err
 	}
 
-	err = json.Unmarshal(metadataBytes.([]byte), &metadata)
-
+	keys, err := deployer.renderKeys(claim)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &metadata, nil
-}
-
-func (deployer *Deployer) getNextValidDeploy() (*RequestMetadata, error) {
-	deploy, err := deployer.getNextDeploy()
+	env, err := envKeys(metadata, keys)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	if deploy == "" {
-		return nil, nil
+	dockerURLKey := keys[0].key
+	restart := keys[len(keys)-1]
+	keys = append(append(keys[:len(keys)-1], env...), restart)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	var changes <-chan EtcdChange
+	transaction := newEtcdTransaction(deployer.etcdClient)
+	for index, key := range keys {
+		if index == len(keys)-1 {
+			changes, err = deployer.watchVerification(metadata.EtcdDir, done)
+			if err != nil {
+				transaction.rollback()
+				return err
+			}
+		}
+
+		if key.unset {
+			err = transaction.unset(key.key)
+		} else {
+			err = transaction.set(key.key, key.value)
+		}
+		if err != nil {
+			transaction.rollback()
+			return err
+		}
+
+		// once the last key is touched the service runs the deploy,
+		// a cancellation landing now is too late to stop it
+		if index == len(keys)-1 {
+			break
+		}
+
+		err = deployer.checkCancelled(claim.Deploy, key.step)
+		if err != nil {
+			transaction.rollback()
+			return err
+		}
 	}
 
-	ok, err := deployer.lockDeploy(deploy)
+	err = deployer.verify(claim, transaction, changes)
 	if err != nil {
-		return nil, err
-	}
-
-	if !ok {
-		debug("Failed to obtain lock for: %v", deploy)
-		return nil, nil
+		return err
 	}
 
-	ok, err = deployer.validateDeploy(deploy)
+	err = deployer.queue.RecordRestart(claim.Deploy)
 	if err != nil {
-		return nil, err
+		log.Printf("could not record that %v restarted the service: %v", claim.Deploy, err)
 	}
+	return deployer.finish(claim, transaction.previous(dockerURLKey))
+}
 
-	if !ok {
-		debug("Deploy was cancelled: %v", deploy)
-		return nil, nil
+// finish reports a deploy that went out as passed and records its release
+func (deployer *Deployer) finish(claim *Claim, snapshot EtcdValue) error {
+	err := deployer.notifyDeployState(claim.Metadata.DockerURL, "passed")
+	if err != nil {
+		return err
 	}
 
-	return deployer.getMetadata(deploy)
+	deployer.recordRelease(claim, snapshot)
+	return nil
 }
 
-func (deployer *Deployer) notifyDeployState(dockerURL string) error {
+// notifyDeployState reports the result of a deploy, passed or failed
+func (deployer *Deployer) notifyDeployState(dockerURL, result string) error {
 	var owner, repo, tag string
 
 	dockerURLParts := strings.Split(dockerURL, ":")
@@ -214,7 +312,7 @@ func (deployer *Deployer) notifyDeployState(dockerURL string) error {
 		return errors.New("invalid base docker url")
 	}
 
-	uri := fmt.Sprintf("deployments/%s/%s/%s/cluster/%s/passed", owner, repo, tag, deployer.cluster)
+	uri := fmt.Sprintf("deployments/%s/%s/%s/cluster/%s/%s", owner, repo, tag, deployer.cluster, result)
 	fullUrl := fmt.Sprintf("%s/%s", deployer.deployStateUri, uri)
 
 	debug("making request to %s", fullUrl)
@@ -235,3 +333,24 @@ func (deployer *Deployer) notifyDeployState(dockerURL string) error {
 	}
 	return nil
 }
+
+func (options *Options) getWorkers() int {
+	if options.Workers > 0 {
+		return options.Workers
+	}
+	return 1
+}
+
+func (options *Options) getLeaseDuration() time.Duration {
+	if options.LeaseDuration > 0 {
+		return options.LeaseDuration
+	}
+	return DefaultLeaseDuration
+}
+
+func (options *Options) getClock() Clock {
+	if options.Clock != nil {
+		return options.Clock
+	}
+	return SystemClock{}
+}
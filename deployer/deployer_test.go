@@ -2,8 +2,10 @@ package deployer_test
 
 import (
 	"fmt"
-	"time"
+	"strings"
+	"sync"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/jarcoal/httpmock"
 	"github.com/octoblu/governator/deployer"
 	"github.com/rafaeljusto/redigomock"
@@ -14,14 +16,23 @@ import (
 
 var _ = Describe("Deployer", func() {
 	var sut *deployer.Deployer
+	var queue *deployer.RedisQueue
 	var redisConn *redigomock.Conn
 	var etcdClient *FakeEtcdClient
 
 	BeforeEach(func() {
 		httpmock.Activate()
 		redisConn = redigomock.NewConn()
+		redisConn.GenericCommand("EXPIRE")
+		redisConn.GenericCommand("GET")
+		redisConn.GenericCommand("SET")
+		noReleases(redisConn)
+		redisConn.GenericCommand("HSET")
+		redisConn.GenericCommand("HGET")
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
 		etcdClient = &FakeEtcdClient{}
-		sut = deployer.New(etcdClient, redisConn, "redis-queue:name", "https://deploy-state.test", "super")
+		queue = deployer.NewRedisQueue(redisPool, "redis-queue:name", &deployer.QueueOptions{InstanceID: "governator-1"})
+		sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", nil)
 	})
 
 	AfterEach(func() {
@@ -34,24 +45,58 @@ var _ = Describe("Deployer", func() {
 
 	Describe("Run", func() {
 		var err error
+		var claim *redigomock.Cmd
+
+		BeforeEach(func() {
+			claim = redisConn.Command(
+				"EVALSHA", redigomock.NewAnyData(), 3,
+				"redis-queue:name:governator:deploys", "redis-queue:name:governator:inflight", "redis-queue:name:governator:deploys:urgent",
+				redigomock.NewAnyInt(), redigomock.NewAnyInt(), "governator-1", "redis-queue:name:", redigomock.NewAnyInt(),
+			)
+		})
 
 		Describe("When there are no pending deploys", func() {
 			BeforeEach(func() {
-				now := time.Now().Unix()
-
-				redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:deploys", 0, now).Expect([]interface{}{})
+				claim.Expect(nil)
 				err = sut.Run()
 			})
 
 			It("Should return right away without an error", func() {
 				Expect(err).To(BeNil())
 			})
+
+			It("Should claim with a single script call", func() {
+				Expect(redisConn.Stats(claim)).To(Equal(1), "EVALSHA was not called enough times")
+			})
+		})
+
+		Describe("When the queue is paused", func() {
+			BeforeEach(func() {
+				redisConn.Command("GET", "redis-queue:name:governator:paused").Expect([]byte("incident 42"))
+				err = sut.Run()
+			})
+
+			It("Should not claim anything", func() {
+				Expect(err).To(BeNil())
+				Expect(redisConn.Stats(claim)).To(Equal(0))
+			})
+		})
+
+		Describe("When redis cannot be reached", func() {
+			BeforeEach(func() {
+				redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, fmt.Errorf("dial tcp: connection refused") }}
+				sut = deployer.New(etcdClient, deployer.NewRedisQueue(redisPool, "redis-queue:name", nil), "https://deploy-state.test", "super", nil)
+				err = sut.Run()
+			})
+
+			It("Should return the dial error", func() {
+				Expect(err).To(MatchError("dial tcp: connection refused"))
+			})
 		})
 
-		Describe("When ZRANGEBYSCORE returns an error", func() {
+		Describe("When the claim script returns an error", func() {
 			BeforeEach(func() {
-				now := time.Now().Unix()
-				redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:deploys", 0, now).ExpectError(fmt.Errorf("things went worse than expected"))
+				claim.ExpectError(fmt.Errorf("things went worse than expected"))
 				err = sut.Run()
 			})
 
@@ -60,124 +105,218 @@ var _ = Describe("Deployer", func() {
 			})
 		})
 
-		Describe("When there are is a pending deploy that should not go out yet", func() {
+		Describe("When the claim script has not been loaded yet", func() {
+			var eval *redigomock.Cmd
+
 			BeforeEach(func() {
-				now := time.Now().Unix()
-				redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:deploys", 0, now).Expect([]interface{}{})
+				claim.ExpectError(redis.Error("NOSCRIPT No matching script. Please use EVAL."))
+				eval = redisConn.GenericCommand("EVAL").Expect(nil)
 				err = sut.Run()
 			})
 
-			It("Should return right away without an error", func() {
+			It("Should fall back to EVAL", func() {
 				Expect(err).To(BeNil())
+				Expect(redisConn.Stats(eval)).To(Equal(1), "EVAL was not called enough times")
 			})
 		})
 
-		Describe("When there are is a pending deploy that should go out", func() {
+		Describe("When the claimed deploy has been cancelled", func() {
 			BeforeEach(func() {
-				now := time.Now().Unix()
-				pendingDeploys := make([]interface{}, 1)
-				pendingDeploys[0] = []byte("pending-deploy-1")
-				redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:deploys", 0, now).Expect(pendingDeploys)
+				claim.Expect([]interface{}{[]byte("pending-deploy-1"), []byte("cancelled")})
+				err = sut.Run()
+			})
+
+			It("Should return with a nil error", func() {
+				Expect(err).To(BeNil())
+			})
+
+			It("Should not touch etcd", func() {
+				Expect(etcdClient.SetCalls).To(BeEmpty())
+			})
+		})
+
+		Describe("When the claimed deploy has no metadata", func() {
+			BeforeEach(func() {
+				claim.Expect([]interface{}{[]byte("pending-deploy-1"), []byte("missing")})
+				err = sut.Run()
+			})
+
+			It("Should return an error", func() {
+				Expect(err).To(MatchError("Deploy metadata not found for 'pending-deploy-1'"))
+			})
+		})
+
+		Describe("When a deploy is claimed", func() {
+			var zremInflight, extendLease, cancellation, statusDeploying *redigomock.Cmd
+
+			BeforeEach(func() {
+				metadata := []byte("{\"etcdDir\":\"/octoblu/my-application\", \"dockerUrl\":\"octoblu/my-application:v1\"}")
+				claim.Expect([]interface{}{[]byte("pending-deploy-1"), []byte("claimed"), metadata, []byte("1000"), []byte("")})
+				zremInflight = redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "pending-deploy-1").Expect(int64(1))
+				extendLease = renewedLease(redisConn, "pending-deploy-1")
+				cancellation = redisConn.Command("HEXISTS", "redis-queue:name:pending-deploy-1", "cancellation").Expect(int64(0))
+				statusDeploying = redisConn.Command("HMSET", "redis-queue:name:pending-deploy-1", "status", "deploying").Expect("OK")
+			})
+
+			It("Should record that it is deploying", func() {
+				sut.Run()
+				Expect(redisConn.Stats(statusDeploying)).To(Equal(1), "HMSET was not called enough times")
+			})
+
+			It("Should record that it is being applied", func() {
+				applied := redisConn.Command("SET", "redis-queue:name:governator:applied:pending-deploy-1", "deploying", "EX", int64(7*24*60*60)).Expect("OK")
+				sut.Run()
+				Expect(redisConn.Stats(applied)).To(Equal(1), "SET was not called enough times")
+			})
+
+			It("Should renew its lease before looking at it and again before deploying", func() {
+				sut.Run()
+				Expect(redisConn.Stats(extendLease)).To(Equal(2), "EVALSHA was not called enough times")
+			})
+
+			Describe("When the deploy succeeds", func() {
+				var statusDone, expire *redigomock.Cmd
+
+				BeforeEach(func() {
+					cancellation.Expect(int64(0)).Expect(int64(0)).Expect(int64(0))
+					statusDone = redisConn.Command("HMSET", "redis-queue:name:pending-deploy-1", "status", "done", "finished:at", redigomock.NewAnyInt()).Expect("OK")
+					expire = redisConn.Command("EXPIRE", "redis-queue:name:pending-deploy-1", int64(7*24*60*60)).Expect(int64(1))
+					rsp := httpmock.NewStringResponder(200, "Ok")
+					httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/my-application/v1/cluster/super/passed", rsp)
+					err = sut.Run()
+				})
+
+				It("Should update the application's docker url", func() {
+					firstCall := etcdClient.SetCalls[0]
+					Expect(firstCall[0]).To(Equal("/octoblu/my-application/docker_url"))
+					Expect(firstCall[1]).To(Equal("octoblu/my-application:v1"))
+				})
+
+				It("Should update the application's sentry release", func() {
+					secondCall := etcdClient.SetCalls[1]
+					Expect(secondCall[0]).To(Equal("/octoblu/my-application/env/SENTRY_RELEASE"))
+					Expect(secondCall[1]).To(Equal("v1"))
+				})
+
+				It("Should touch restart", func() {
+					thirdCall := etcdClient.SetCalls[2]
+					Expect(thirdCall[0]).To(Equal("/octoblu/my-application/restart"))
+					Expect(thirdCall[1]).NotTo(BeNil())
+				})
+
+				It("Should release the deploy", func() {
+					Expect(err).To(BeNil())
+					Expect(redisConn.Stats(zremInflight)).To(Equal(1), "ZREM was not called enough times")
+				})
+
+				It("Should record that it is done", func() {
+					Expect(redisConn.Stats(statusDone)).To(Equal(1), "HMSET was not called enough times")
+				})
+
+				It("Should let redis expire its hash", func() {
+					Expect(redisConn.Stats(expire)).To(Equal(1), "EXPIRE was not called enough times")
+				})
 			})
 
-			Describe("When attempting to ZREM the record yields no change", func() {
-				var zrem *redigomock.Cmd
+			Describe("When the deploy is cancelled while in flight", func() {
+				var statusCancelled *redigomock.Cmd
 
 				BeforeEach(func() {
-					zrem = redisConn.Command("ZREM", "redis-queue:name:governator:deploys", "pending-deploy-1").Expect(int64(0))
-					sut.Run()
+					cancellation.Expect(int64(1))
+					statusCancelled = redisConn.Command("HMSET", "redis-queue:name:pending-deploy-1", "status", "cancelled", "finished:at", redigomock.NewAnyInt(), "cancelled:after", "docker_url").Expect("OK")
+					err = sut.Run()
+				})
+
+				It("Should not error", func() {
+					Expect(err).To(BeNil())
+				})
+
+				It("Should stop before touching restart", func() {
+					Expect(etcdClient.SetCalls).To(HaveLen(1))
+					Expect(etcdClient.SetCalls[0][0]).To(Equal("/octoblu/my-application/docker_url"))
+				})
+
+				It("Should roll back the docker url", func() {
+					Expect(etcdClient.DeleteCalls).To(Equal([]string{"/octoblu/my-application/docker_url"}))
 				})
 
-				It("Should return try to delete the record", func() {
-					Expect(redisConn.Stats(zrem)).To(Equal(1), "ZREM was not called enough times")
+				It("Should record how far it got", func() {
+					Expect(redisConn.Stats(statusCancelled)).To(Equal(1), "HMSET was not called enough times")
+					Expect(redisConn.Stats(zremInflight)).To(Equal(1), "ZREM was not called enough times")
 				})
 			})
 
-			Describe("When attempting to ZREM yields an error", func() {
+			Describe("When etcd Set returns an error", func() {
+				var statusRetrying, zaddRetry *redigomock.Cmd
+
 				BeforeEach(func() {
-					redisConn.Command("ZREM", "redis-queue:name:governator:deploys", "pending-deploy-1").ExpectError(fmt.Errorf("something wong"))
+					redisConn.Command("HINCRBY", "redis-queue:name:pending-deploy-1", "attempts", 1).Expect(int64(1))
+					statusRetrying = redisConn.Command("HMSET", "redis-queue:name:pending-deploy-1", "status", "retrying", "error", "The server is gone, url is wrong, etc(d)...").Expect("OK")
+					zaddRetry = redisConn.Command("ZADD", "redis-queue:name:governator:deploys", redigomock.NewAnyInt(), "pending-deploy-1").Expect(int64(1))
+					etcdClient.SetError = fmt.Errorf("The server is gone, url is wrong, etc(d)...")
 					err = sut.Run()
 				})
 
-				It("Should return try to delete the record", func() {
-					Expect(err).To(MatchError("something wong"))
+				It("Should not error", func() {
+					Expect(err).To(BeNil())
+				})
+
+				It("Should record the error", func() {
+					Expect(redisConn.Stats(statusRetrying)).To(Equal(1), "HMSET was not called enough times")
 				})
+
+				It("Should schedule a retry and release the deploy", func() {
+					Expect(redisConn.Stats(zaddRetry)).To(Equal(1), "ZADD was not called enough times")
+					Expect(redisConn.Stats(zremInflight)).To(Equal(1), "ZREM was not called enough times")
+				})
+			})
+		})
+	})
+
+	Describe("Recover", func() {
+		var err error
+
+		Describe("When there are no expired leases", func() {
+			BeforeEach(func() {
+				redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:inflight", 0, redigomock.NewAnyInt()).Expect([]interface{}{})
+				err = queue.Recover()
 			})
 
-			Describe("When attempting to ZREM the record succeeds", func() {
+			It("Should return without an error", func() {
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Describe("When there is an expired lease", func() {
+			var recover *redigomock.Cmd
+
+			BeforeEach(func() {
+				redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:inflight", 0, redigomock.NewAnyInt()).Expect([]interface{}{[]byte("pending-deploy-1")})
+				recover = redisConn.Command("EVALSHA", redigomock.NewAnyData(), 3,
+					"redis-queue:name:governator:inflight", "redis-queue:name:governator:deploys", "redis-queue:name:governator:deploys:urgent",
+					redigomock.NewAnyInt(), "pending-deploy-1", "redis-queue:name:", 3, int64(7*24*60*60))
+			})
+
+			Describe("When the deploy is requeued", func() {
 				BeforeEach(func() {
-					redisConn.Command("ZREM", "redis-queue:name:governator:deploys", "pending-deploy-1").Expect(int64(1))
-				})
-
-				Describe("When the deploy has been cancelled", func() {
-					BeforeEach(func() {
-						redisConn.Command("HEXISTS", "redis-queue:name:pending-deploy-1", "cancellation").Expect(int64(1))
-						err = sut.Run()
-					})
-
-					It("Should return with a nil error", func() {
-						Expect(err).To(BeNil())
-					})
-				})
-
-				Describe("When the deploy not been cancelled", func() {
-					BeforeEach(func() {
-						redisConn.Command("HEXISTS", "redis-queue:name:pending-deploy-1", "cancellation").Expect(int64(0))
-					})
-
-					Describe("When the metadata doesn't exist", func() {
-						BeforeEach(func() {
-							redisConn.Command("HGET", "redis-queue:name:pending-deploy-1", "request:metadata").Expect(nil)
-							err = sut.Run()
-						})
-
-						It("Should return an error", func() {
-							Expect(err).To(MatchError("Deploy metadata not found for 'pending-deploy-1'"))
-						})
-					})
-
-					Describe("When the metadata exists", func() {
-						BeforeEach(func() {
-							cmd := redisConn.Command("HGET", "redis-queue:name:pending-deploy-1", "request:metadata")
-							cmd.Expect([]byte("{\"etcdDir\":\"/octoblu/my-application\", \"dockerUrl\":\"octoblu/my-application:v1\"}"))
-							rsp := httpmock.NewStringResponder(200, "Ok")
-							httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/my-application/v1/cluster/super/passed", rsp)
-							err = sut.Run()
-						})
-
-						It("Should update the application's docker url", func() {
-							firstCall := etcdClient.SetCalls[0]
-							Expect(firstCall[0]).To(Equal("/octoblu/my-application/docker_url"))
-							Expect(firstCall[1]).To(Equal("octoblu/my-application:v1"))
-						})
-
-						It("Should update the application's sentry release", func() {
-							secondCall := etcdClient.SetCalls[1]
-							Expect(secondCall[0]).To(Equal("/octoblu/my-application/env/SENTRY_RELEASE"))
-							Expect(secondCall[1]).To(Equal("v1"))
-						})
-
-						It("Should touch restart", func() {
-							thirdCall := etcdClient.SetCalls[2]
-							Expect(thirdCall[0]).To(Equal("/octoblu/my-application/restart"))
-							Expect(thirdCall[1]).NotTo(BeNil())
-						})
-					})
-				})
-
-				Describe("When the deploy not been cancelled, but etcd Set returns an error", func() {
-					BeforeEach(func() {
-						redisConn.Command("HEXISTS", "redis-queue:name:pending-deploy-1", "cancellation").Expect(int64(0))
-						cmd := redisConn.Command("HGET", "redis-queue:name:pending-deploy-1", "request:metadata")
-						cmd.Expect([]byte("{\"etcdDir\":\"/octoblu/my-application\", \"dockerUrl\":\"octoblu/my-application:version\"}"))
-
-						etcdClient.SetError = fmt.Errorf("The server is gone, url is wrong, etc(d)...")
-						err = sut.Run()
-					})
-
-					It("Should error", func() {
-						Expect(err).To(MatchError("The server is gone, url is wrong, etc(d)..."))
-					})
+					recover.Expect([]byte("requeued"))
+					err = queue.Recover()
+				})
+
+				It("Should check and requeue it in one step", func() {
+					Expect(err).To(BeNil())
+					Expect(redisConn.Stats(recover)).To(Equal(1), "EVALSHA was not called enough times")
+				})
+			})
+
+			Describe("When the recovery fails", func() {
+				BeforeEach(func() {
+					recover.ExpectError(fmt.Errorf("redis is gone"))
+					err = queue.Recover()
+				})
+
+				It("Should return the error", func() {
+					Expect(err).To(MatchError("redis is gone"))
 				})
 			})
 		})
@@ -185,16 +324,102 @@ var _ = Describe("Deployer", func() {
 })
 
 type FakeEtcdClient struct {
-	SetCalls [][]string
-	SetError error
+	Values      map[string]string
+	SetCalls    [][]string
+	DeleteCalls []string
+	SetError    error
+	GetError    error
+	KeyErrors   map[string]error
+	OnSet       func(key string)
+	watches     []fakeWatch
+	mutex       sync.Mutex
+}
+
+type fakeWatch struct {
+	key     string
+	changes chan deployer.EtcdChange
+}
+
+func (etcdClient *FakeEtcdClient) Get(key string) (string, error) {
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+	return etcdClient.Values[key], etcdClient.GetError
+}
+
+func (etcdClient *FakeEtcdClient) Lookup(key string) (deployer.EtcdValue, error) {
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+	value, exists := etcdClient.Values[key]
+	return deployer.EtcdValue{Value: value, Exists: exists}, nil
 }
 
-func (etcdClient *FakeEtcdClient) Get(string) (string, error) {
-	return "", nil
+func (etcdClient *FakeEtcdClient) CompareAndSwap(key string, previous, next deployer.EtcdValue) error {
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+
+	if next.Exists {
+		etcdClient.SetCalls = append(etcdClient.SetCalls, []string{key, next.Value})
+		if etcdClient.OnSet != nil {
+			etcdClient.OnSet(key)
+		}
+		if etcdClient.SetError != nil {
+			return etcdClient.SetError
+		}
+		if err := etcdClient.KeyErrors[key]; err != nil {
+			return err
+		}
+	} else {
+		etcdClient.DeleteCalls = append(etcdClient.DeleteCalls, key)
+	}
+
+	value, exists := etcdClient.Values[key]
+	if exists != previous.Exists || value != previous.Value {
+		return fmt.Errorf("etcd key %v changed meanwhile", key)
+	}
+
+	if etcdClient.Values == nil {
+		etcdClient.Values = make(map[string]string)
+	}
+	if next.Exists {
+		etcdClient.Values[key] = next.Value
+	} else {
+		delete(etcdClient.Values, key)
+	}
+	return nil
 }
 
-func (etcdClient *FakeEtcdClient) Set(key, value string) error {
-	etcdClient.SetCalls = append(etcdClient.SetCalls, []string{key, value})
+func (etcdClient *FakeEtcdClient) WatchRecursive(key string, done <-chan struct{}) (<-chan deployer.EtcdChange, error) {
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+
+	changes := make(chan deployer.EtcdChange, 10)
+	etcdClient.watches = append(etcdClient.watches, fakeWatch{key: key, changes: changes})
+	return changes, nil
+}
+
+// Publish sends a change to the watches of the keys above it, it is meant
+// to be called from OnSet, like a service reporting in after its restart
+func (etcdClient *FakeEtcdClient) Publish(key, value string) {
+	for _, watch := range etcdClient.watches {
+		if strings.HasPrefix(key, watch.key+"/") {
+			watch.changes <- deployer.EtcdChange{Key: key, Value: value}
+		}
+	}
+}
+
+// renewedLease makes redis renew the lease of the deploy whenever asked to
+func renewedLease(redisConn *redigomock.Conn, deploy string) *redigomock.Cmd {
+	renew := redisConn.Command("EVALSHA", redigomock.NewAnyData(), 2, "redis-queue:name:governator:inflight", "redis-queue:name:"+deploy, redigomock.NewAnyInt(), deploy, "governator-1")
+	for renewal := 0; renewal < 8; renewal++ {
+		renew.Expect(int64(1))
+	}
+	return renew
+}
 
-	return etcdClient.SetError
+// noReleases makes redis answer that no etcdDir has releases recorded
+func noReleases(redisConn *redigomock.Conn) {
+	lrange := redisConn.GenericCommand("LRANGE")
+	for read := 0; read < 8; read++ {
+		lrange.Expect([]interface{}{})
+	}
 }
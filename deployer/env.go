@@ -0,0 +1,100 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// redacted replaces the env values of a deploy wherever they would be shown
+const redacted = "[redacted]"
+
+// hasEnvChanges tells whether the deploy writes or removes env keys
+func (metadata *RequestMetadata) hasEnvChanges() bool {
+	return len(metadata.Env) > 0 || len(metadata.UnsetEnv) > 0
+}
+
+// Redacted returns a copy of the metadata with the env values hidden,
+// the names stay so it still tells what the deploy changes
+func (metadata *RequestMetadata) Redacted() *RequestMetadata {
+	copied := *metadata
+	if metadata.Env == nil {
+		return &copied
+	}
+
+	copied.Env = make(map[string]string, len(metadata.Env))
+	for name := range metadata.Env {
+		copied.Env[name] = redacted
+	}
+	return &copied
+}
+
+// RedactRequestMetadata hides the env values of a request:metadata field,
+// a value that is not request metadata is returned as is
+func RedactRequestMetadata(value string) string {
+	var metadata RequestMetadata
+	err := json.Unmarshal([]byte(value), &metadata)
+	if err != nil || metadata.Env == nil {
+		return value
+	}
+
+	redactedBytes, err := json.Marshal(metadata.Redacted())
+	if err != nil {
+		return value
+	}
+	return string(redactedBytes)
+}
+
+// envKeys returns the keys under <etcdDir>/env/ a deploy writes or removes,
+// sorted by name so they are always written in the same order. None of
+// them may be a key of the layout, those hold the docker url or restart
+func envKeys(metadata *RequestMetadata, layoutKeys []etcdKey) ([]etcdKey, error) {
+	reserved := make(map[string]bool, len(layoutKeys))
+	for _, layoutKey := range layoutKeys {
+		reserved[layoutKey.key] = true
+	}
+
+	var names []string
+	for name := range metadata.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := make([]etcdKey, 0, len(names)+len(metadata.UnsetEnv))
+	for _, name := range names {
+		key, err := envKey(metadata.EtcdDir, name, reserved)
+		if err != nil {
+			return nil, err
+		}
+		key.value = metadata.Env[name]
+		keys = append(keys, key)
+	}
+
+	for _, name := range metadata.UnsetEnv {
+		if _, ok := metadata.Env[name]; ok {
+			return nil, fmt.Errorf("Env %v is both set and unset", name)
+		}
+
+		key, err := envKey(metadata.EtcdDir, name, reserved)
+		if err != nil {
+			return nil, err
+		}
+		key.unset = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func envKey(etcdDir, name string, reserved map[string]bool) (etcdKey, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return etcdKey{}, fmt.Errorf("Invalid env name '%v'", name)
+	}
+
+	step := "env/" + name
+	key := etcdKey{key: fmt.Sprintf("%v/%v", strings.TrimSuffix(etcdDir, "/"), step), step: step}
+	if reserved[key.key] {
+		return etcdKey{}, fmt.Errorf("Env %v is written by the key layout already", name)
+	}
+	return key, nil
+}
@@ -1,21 +1,155 @@
 package deployer
 
 import (
-	"github.com/octoblu/go-simple-etcd-client/etcdclient"
+	"fmt"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
 )
 
 // EtcdClient defines the methods needed from the etcdclient
 type EtcdClient interface {
+	// Get returns the value of a key, empty when it does not exist
 	Get(key string) (string, error)
-	Set(key, value string) error
+
+	// Lookup returns the value of a key along with whether it exists
+	Lookup(key string) (EtcdValue, error)
+
+	// CompareAndSwap replaces the value of a key only while it still is
+	// previous. A previous that does not exist expects the key missing,
+	// a next that does not exist deletes the key
+	CompareAndSwap(key string, previous, next EtcdValue) error
+
+	// WatchRecursive sends every change under the key made after it was
+	// called, until done is closed. The channel is closed when the watch
+	// ends, after a change carrying the error when it failed
+	WatchRecursive(key string, done <-chan struct{}) (<-chan EtcdChange, error)
 }
 
-// SimpleEtcdClient implements the EtcdClient
-type SimpleEtcdClient struct {
-	etcdclient.EtcdClient
+// EtcdValue is the value of a key, Exists is false for a missing key
+type EtcdValue struct {
+	Value  string
+	Exists bool
+}
+
+// EtcdChange is a key that changed under a watched key, Value is empty
+// for a deleted key. Err is set on the last change of a failed watch
+type EtcdChange struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+// KeysEtcdClient implements the EtcdClient with the etcd v2 keys api
+type KeysEtcdClient struct {
+	keysAPI client.KeysAPI
+}
+
+// DialEtcd creates a new instance of the etcd client
+func DialEtcd(etcdURI string) (*KeysEtcdClient, error) {
+	etcd, err := client.New(client.Config{
+		Endpoints: []string{etcdURI},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeysEtcdClient{keysAPI: client.NewKeysAPI(etcd)}, nil
+}
+
+// Get returns the value of a key, empty when it does not exist
+func (etcdClient *KeysEtcdClient) Get(key string) (string, error) {
+	value, err := etcdClient.Lookup(key)
+	return value.Value, err
+}
+
+// Lookup returns the value of a key along with whether it exists
+func (etcdClient *KeysEtcdClient) Lookup(key string) (EtcdValue, error) {
+	response, err := etcdClient.keysAPI.Get(context.Background(), key, nil)
+	if client.IsKeyNotFound(err) {
+		return EtcdValue{}, nil
+	}
+	if err != nil {
+		return EtcdValue{}, err
+	}
+	return EtcdValue{Value: response.Node.Value, Exists: true}, nil
+}
+
+// CompareAndSwap replaces the value of a key only while it still is previous
+func (etcdClient *KeysEtcdClient) CompareAndSwap(key string, previous, next EtcdValue) error {
+	var err error
+
+	if next.Exists {
+		options := &client.SetOptions{PrevExist: client.PrevNoExist}
+		if previous.Exists {
+			options = &client.SetOptions{PrevExist: client.PrevExist, PrevValue: previous.Value}
+		}
+		_, err = etcdClient.keysAPI.Set(context.Background(), key, next.Value, options)
+	} else if previous.Exists {
+		_, err = etcdClient.keysAPI.Delete(context.Background(), key, &client.DeleteOptions{PrevValue: previous.Value})
+	}
+
+	if etcdErr, ok := err.(client.Error); ok {
+		switch etcdErr.Code {
+		case client.ErrorCodeTestFailed, client.ErrorCodeNodeExist, client.ErrorCodeKeyNotFound:
+			return fmt.Errorf("etcd key %v changed meanwhile", key)
+		}
+	}
+	return err
+}
+
+// WatchRecursive sends every change under the key made after it was called
+func (etcdClient *KeysEtcdClient) WatchRecursive(key string, done <-chan struct{}) (<-chan EtcdChange, error) {
+	afterIndex, err := etcdClient.currentIndex(key)
+	if err != nil {
+		return nil, err
+	}
+
+	watchContext, cancel := context.WithCancel(context.Background())
+	watcher := etcdClient.keysAPI.Watcher(key, &client.WatcherOptions{AfterIndex: afterIndex, Recursive: true})
+	changes := make(chan EtcdChange)
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	go func() {
+		defer close(changes)
+		for {
+			var change EtcdChange
+			response, err := watcher.Next(watchContext)
+			if err != nil {
+				if watchContext.Err() != nil {
+					return
+				}
+				change.Err = err
+			} else {
+				change.Key, change.Value = response.Node.Key, response.Node.Value
+			}
+
+			select {
+			case changes <- change:
+			case <-done:
+				return
+			}
+
+			if change.Err != nil {
+				return
+			}
+		}
+	}()
+	return changes, nil
 }
 
-// NewEtcdClient creates a new instance of the etcd client
-func NewEtcdClient(client etcdclient.EtcdClient) EtcdClient {
-	return &SimpleEtcdClient{client}
+// currentIndex returns the etcd index as of now, a watch after it
+// sees the changes from now on, even when the key does not exist yet
+func (etcdClient *KeysEtcdClient) currentIndex(key string) (uint64, error) {
+	response, err := etcdClient.keysAPI.Get(context.Background(), key, nil)
+	if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+		return etcdErr.Index, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return response.Index, nil
 }
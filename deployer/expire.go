@@ -0,0 +1,42 @@
+package deployer
+
+import (
+	"log"
+	"time"
+)
+
+// getDeadline returns when the claimed deploy expires, the deadline of its
+// request or max lateness after it was due, whichever comes first.
+// It is zero for a deploy that never expires
+func (deployer *Deployer) getDeadline(claim *Claim) time.Time {
+	var deadline time.Time
+	if claim.Metadata.Deadline > 0 {
+		deadline = time.Unix(claim.Metadata.Deadline, 0)
+	}
+
+	if deployer.maxLateness > 0 && !claim.DueAt.IsZero() {
+		latest := claim.DueAt.Add(deployer.maxLateness)
+		if deadline.IsZero() || latest.Before(deadline) {
+			deadline = latest
+		}
+	}
+	return deadline
+}
+
+// expire records a deploy that missed its deadline as expired, without
+// rolling it out, then reports it to the deploy state service as failed.
+// It is recorded first so a failing report cannot put it back on the
+// queue, where it would be due anew, so the report is only logged
+func (deployer *Deployer) expire(claim *Claim, deadline time.Time) error {
+	log.Printf("deploy %v expired at %v, not rolling it out", claim.Deploy, deadline)
+	err := deployer.ack(claim.Deploy, StatusExpired, "expired:at", unixString(deadline))
+	if err != nil {
+		return err
+	}
+
+	err = deployer.notifyDeployState(claim.Metadata.DockerURL, "failed")
+	if err != nil {
+		log.Printf("could not report expired deploy %v failed: %v", claim.Deploy, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package deployer
+
+import (
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// scanCount is how many keys SCAN looks at per call
+const scanCount = 1000
+
+// finishedStatuses are the statuses after which a deploy is never claimed again
+var finishedStatuses = map[string]bool{
+	StatusDone:       true,
+	StatusFailed:     true,
+	StatusCancelled:  true,
+	StatusSkipped:    true,
+	StatusSuperseded: true,
+	StatusExpired:    true,
+}
+
+// Orphans scans the namespace of the queue for deploy hashes that redis
+// will not expire and that no zset refers to anymore, like the hashes of
+// deploys finished before the deploy TTL existed. The pattern matches the
+// keys of queues named like <queue>:<name> as well, a key with a : left
+// after the prefix is only left alone when such a queue has governator
+// keys of its own, deploy names may have a : too
+func (queue *RedisQueue) Orphans() ([]string, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	prefix := queue.getKey("")
+	pattern := escapeGlob(prefix) + "*"
+
+	var deploys, nested []string
+	siblings := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := redis.Values(redisConn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+		_, err = redis.Scan(reply, &cursor, &keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			deploy := strings.TrimPrefix(key, prefix)
+			if strings.HasPrefix(deploy, "governator:") {
+				continue
+			}
+
+			if index := strings.Index(deploy, ":governator:"); index >= 0 {
+				siblings[deploy[:index]] = true
+				continue
+			}
+
+			if strings.Contains(deploy, ":") {
+				nested = append(nested, deploy)
+				continue
+			}
+			deploys = append(deploys, deploy)
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	// only once every key was seen is it known which queues are siblings
+	for _, deploy := range nested {
+		if !isOfSibling(deploy, siblings) {
+			deploys = append(deploys, deploy)
+		}
+	}
+
+	var orphans []string
+	for _, deploy := range deploys {
+		orphan, err := queue.isOrphan(redisConn, deploy)
+		if err != nil {
+			return nil, err
+		}
+
+		if orphan {
+			orphans = append(orphans, deploy)
+		}
+	}
+	return orphans, nil
+}
+
+// isOfSibling tells whether the key left after the prefix belongs to
+// one of the queues named <queue>:<sibling>
+func isOfSibling(deploy string, siblings map[string]bool) bool {
+	for sibling := range siblings {
+		if strings.HasPrefix(deploy, sibling+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveOrphan deletes the hash of a deploy Orphans returned, it checks
+// again first and tells whether the hash was deleted
+func (queue *RedisQueue) RemoveOrphan(deploy string) (bool, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	orphan, err := queue.isOrphan(redisConn, deploy)
+	if err != nil || !orphan {
+		return false, err
+	}
+
+	return redis.Bool(redisConn.Do("DEL", queue.getKey(deploy)))
+}
+
+// isOrphan tells whether the deploy has a hash without a TTL that no zset
+// refers to and that will never be claimed again. That is a finished
+// deploy, or one without metadata. Deploys waiting in the stream of a
+// StreamQueue are in no zset, but they are not finished and keep their metadata
+func (queue *RedisQueue) isOrphan(redisConn redis.Conn, deploy string) (bool, error) {
+	key := queue.getKey(deploy)
+
+	keyType, err := redis.String(redisConn.Do("TYPE", key))
+	if err != nil || keyType != "hash" {
+		return false, err
+	}
+
+	ttl, err := redis.Int64(redisConn.Do("TTL", key))
+	if err != nil || ttl >= 0 {
+		return false, err
+	}
+
+	for _, zset := range []string{"governator:deploys", "governator:deploys:urgent", "governator:inflight", "governator:deadletter"} {
+		_, err := redis.String(redisConn.Do("ZSCORE", queue.getKey(zset), deploy))
+		if err == nil {
+			return false, nil
+		}
+		if err != redis.ErrNil {
+			return false, err
+		}
+	}
+
+	fields, err := redis.StringMap(redisConn.Do("HGETALL", key))
+	if err != nil {
+		return false, err
+	}
+
+	_, hasMetadata := fields["request:metadata"]
+	return finishedStatuses[fields["status"]] || !hasMetadata, nil
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats as a pattern
+func escapeGlob(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(value)
+}
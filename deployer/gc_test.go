@@ -0,0 +1,98 @@
+package deployer_test
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GC", func() {
+	var queue *deployer.RedisQueue
+	var redisConn *redigomock.Conn
+
+	BeforeEach(func() {
+		redisConn = redigomock.NewConn()
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
+		queue = deployer.NewRedisQueue(redisPool, "redis-queue:name", nil)
+
+		redisConn.Command("SCAN", "0", "MATCH", "redis-queue:name:*", "COUNT", 1000).Expect([]interface{}{
+			[]byte("7"),
+			[]interface{}{[]byte("redis-queue:name:governator:deploys"), []byte("redis-queue:name:deploy-1")},
+		})
+		redisConn.Command("SCAN", "7", "MATCH", "redis-queue:name:*", "COUNT", 1000).Expect([]interface{}{
+			[]byte("0"),
+			[]interface{}{
+				[]byte("redis-queue:name:deploy-2"), []byte("redis-queue:name:deploy-3"), []byte("redis-queue:name:deploy-4"),
+				[]byte("redis-queue:name:east:deploy-5"), []byte("redis-queue:name:east:governator:deploys"),
+				[]byte("redis-queue:name:service-a:v2"),
+			},
+		})
+
+		for _, deploy := range []string{"deploy-1", "deploy-2", "deploy-3", "deploy-4", "service-a:v2"} {
+			redisConn.Command("TYPE", "redis-queue:name:"+deploy).Expect("hash")
+		}
+		redisConn.Command("TTL", "redis-queue:name:deploy-1").Expect(int64(-1))
+		redisConn.Command("TTL", "redis-queue:name:deploy-2").Expect(int64(-1))
+		redisConn.Command("TTL", "redis-queue:name:deploy-3").Expect(int64(3600))
+		redisConn.Command("TTL", "redis-queue:name:deploy-4").Expect(int64(-1))
+		redisConn.Command("TTL", "redis-queue:name:service-a:v2").Expect(int64(-1))
+
+		redisConn.GenericCommand("ZSCORE")
+		redisConn.Command("ZSCORE", "redis-queue:name:governator:deploys", "deploy-4").Expect([]byte("1000"))
+
+		redisConn.Command("HGETALL", "redis-queue:name:deploy-1").Expect([]interface{}{
+			[]byte("status"), []byte("done"),
+			[]byte("request:metadata"), []byte("{}"),
+		})
+		redisConn.Command("HGETALL", "redis-queue:name:service-a:v2").Expect([]interface{}{
+			[]byte("status"), []byte("failed"),
+			[]byte("request:metadata"), []byte("{}"),
+		})
+		redisConn.Command("HGETALL", "redis-queue:name:deploy-2").Expect([]interface{}{
+			[]byte("status"), []byte("pending"),
+			[]byte("request:metadata"), []byte("{}"),
+		})
+	})
+
+	Describe("Orphans", func() {
+		var orphans []string
+		var err error
+
+		BeforeEach(func() {
+			orphans, err = queue.Orphans()
+		})
+
+		It("Should only list finished deploys that no zset refers to and redis will not expire", func() {
+			Expect(err).To(BeNil())
+			Expect(orphans).To(Equal([]string{"deploy-1", "service-a:v2"}))
+		})
+
+		It("Should leave the deploys of queues named like this one alone, but not deploys named with a colon", func() {
+			Expect(orphans).NotTo(ContainElement("east:deploy-5"))
+		})
+	})
+
+	Describe("RemoveOrphan", func() {
+		var del *redigomock.Cmd
+
+		BeforeEach(func() {
+			del = redisConn.GenericCommand("DEL").Expect(int64(1))
+		})
+
+		It("Should delete an orphaned hash", func() {
+			removed, err := queue.RemoveOrphan("deploy-1")
+			Expect(err).To(BeNil())
+			Expect(removed).To(BeTrue())
+		})
+
+		It("Should leave a deploy that is still queued alone", func() {
+			removed, err := queue.RemoveOrphan("deploy-4")
+			Expect(err).To(BeNil())
+			Expect(removed).To(BeFalse())
+			Expect(redisConn.Stats(del)).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,192 @@
+package deployer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// KeyTemplate is one etcd key written per deploy, Key and Value are
+// text/template templates executed with the KeyData of the deploy
+type KeyTemplate struct {
+	Key   string
+	Value string
+}
+
+// KeyData is what the templates of a KeyLayout can use
+type KeyData struct {
+	EtcdDir   string
+	DockerURL string
+	Image     string
+	Tag       string
+	Deploy    string
+	Cluster   string
+	Time      time.Time
+}
+
+// KeyLayout is the set of keys written per deploy, in order. The first
+// key holds the docker url, it tells whether the etcdDir already runs a
+// deploy and what a release replaced. The last key is the one that
+// restarts the service
+type KeyLayout struct {
+	keys []*keyTemplate
+}
+
+// KeyLayouts picks the KeyLayout of an etcdDir, etcdDirs without
+// a layout of their own use Default or else DefaultKeyLayout
+type KeyLayouts struct {
+	Default  *KeyLayout
+	EtcdDirs map[string]*KeyLayout
+}
+
+type keyTemplate struct {
+	key   *template.Template
+	value *template.Template
+}
+
+// etcdKey is a rendered KeyTemplate or an env change, step is the key
+// relative to the etcdDir and unset removes the key instead
+type etcdKey struct {
+	key   string
+	step  string
+	value string
+	unset bool
+}
+
+// DefaultKeyLayout writes docker_url, env/SENTRY_RELEASE and restart
+var DefaultKeyLayout = mustKeyLayout([]KeyTemplate{
+	{Key: "{{.EtcdDir}}/docker_url", Value: "{{.DockerURL}}"},
+	{Key: "{{.EtcdDir}}/env/SENTRY_RELEASE", Value: "{{.Tag}}"},
+	{Key: "{{.EtcdDir}}/restart", Value: "{{.Time}}"},
+})
+
+// NewKeyLayout parses the templates of a layout, every one is tried on an
+// example deploy so mistakes show up before the first deploy does
+func NewKeyLayout(templates []KeyTemplate) (*KeyLayout, error) {
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("Key layout needs at least one key")
+	}
+
+	layout := &KeyLayout{}
+	for _, config := range templates {
+		keyTemplate, err := parseKeyTemplate(config)
+		if err != nil {
+			return nil, err
+		}
+		layout.keys = append(layout.keys, keyTemplate)
+	}
+
+	example := exampleKeyData()
+	keys, err := layout.render(example)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys[0].value != example.DockerURL {
+		return nil, fmt.Errorf("The first key of a layout has to hold the docker url, '%v' holds '%v'", keys[0].key, keys[0].value)
+	}
+	return layout, nil
+}
+
+func mustKeyLayout(templates []KeyTemplate) *KeyLayout {
+	layout, err := NewKeyLayout(templates)
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+func parseKeyTemplate(config KeyTemplate) (*keyTemplate, error) {
+	key, err := template.New(config.Key).Option("missingkey=error").Parse(config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := template.New(config.Value).Option("missingkey=error").Parse(config.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &keyTemplate{key: key, value: value}, nil
+}
+
+// exampleKeyData is the deploy templates are tried on when they are parsed
+func exampleKeyData() *KeyData {
+	return newKeyData("/octoblu/example", "octoblu/example:v1.0.0", "example-deploy", "example-cluster", time.Now())
+}
+
+func newKeyData(etcdDir, dockerURL, deploy, cluster string, now time.Time) *KeyData {
+	tag := dockerURL[strings.LastIndex(dockerURL, ":")+1:]
+	return &KeyData{
+		EtcdDir:   etcdDir,
+		DockerURL: dockerURL,
+		Image:     strings.TrimSuffix(dockerURL, ":"+tag),
+		Tag:       tag,
+		Deploy:    deploy,
+		Cluster:   cluster,
+		Time:      now,
+	}
+}
+
+func (layout *KeyLayout) render(data *KeyData) ([]etcdKey, error) {
+	keys := make([]etcdKey, 0, len(layout.keys))
+	for _, keyTemplate := range layout.keys {
+		key, err := keyTemplate.render(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (keyTemplate *keyTemplate) render(data *KeyData) (etcdKey, error) {
+	key, err := executeTemplate(keyTemplate.key, data)
+	if err != nil {
+		return etcdKey{}, err
+	}
+
+	if key == "" {
+		return etcdKey{}, fmt.Errorf("Key template '%v' is empty for %v", keyTemplate.key.Name(), data.Deploy)
+	}
+
+	value, err := executeTemplate(keyTemplate.value, data)
+	if err != nil {
+		return etcdKey{}, err
+	}
+
+	step := strings.TrimPrefix(key, strings.TrimSuffix(data.EtcdDir, "/")+"/")
+	return etcdKey{key: key, step: step, value: value}, nil
+}
+
+func (layouts *KeyLayouts) get(etcdDir string) *KeyLayout {
+	if layouts == nil {
+		return DefaultKeyLayout
+	}
+
+	if layout, ok := layouts.EtcdDirs[etcdDir]; ok {
+		return layout
+	}
+
+	if layouts.Default != nil {
+		return layouts.Default
+	}
+	return DefaultKeyLayout
+}
+
+// renderKeys returns the keys a deploy writes, in order
+func (deployer *Deployer) renderKeys(claim *Claim) ([]etcdKey, error) {
+	metadata := claim.Metadata
+	data := newKeyData(metadata.EtcdDir, metadata.DockerURL, claim.Deploy, deployer.cluster, time.Now())
+	return deployer.keyLayouts.get(metadata.EtcdDir).render(data)
+}
+
+func executeTemplate(theTemplate *template.Template, data *KeyData) (string, error) {
+	var buffer bytes.Buffer
+	err := theTemplate.Execute(&buffer, data)
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,121 @@
+package deployer_test
+
+import (
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/octoblu/governator/deployer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KeyLayout", func() {
+	var sut *deployer.Deployer
+	var queue *deployer.MemoryQueue
+	var etcdClient *FakeEtcdClient
+	var err error
+
+	BeforeEach(func() {
+		httpmock.Activate()
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/passed", httpmock.NewStringResponder(200, "Ok"))
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-b/v1/cluster/super/passed", httpmock.NewStringResponder(200, "Ok"))
+
+		plain, _ := deployer.NewKeyLayout([]deployer.KeyTemplate{
+			{Key: "{{.EtcdDir}}/image", Value: "{{.DockerURL}}"},
+			{Key: "{{.EtcdDir}}/deployed-by", Value: "{{.Deploy}} on {{.Cluster}} of {{.Image}}"},
+			{Key: "{{.EtcdDir}}/restart", Value: "{{.Tag}}"},
+		})
+
+		clock := deployer.NewManualClock(time.Unix(1000, 0))
+		queue = deployer.NewMemoryQueue(&deployer.QueueOptions{Clock: clock})
+		etcdClient = &FakeEtcdClient{}
+		sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{
+			Clock:      clock,
+			KeyLayouts: &deployer.KeyLayouts{EtcdDirs: map[string]*deployer.KeyLayout{"/octoblu/service-b": plain}},
+		})
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	Describe("When the etcdDir has a layout of its own", func() {
+		BeforeEach(func() {
+			queue.Enqueue("deploy-1", time.Unix(1000, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-b", DockerURL: "octoblu/service-b:v1"})
+			err = sut.Run()
+		})
+
+		It("Should write the keys of that layout", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.Values).To(Equal(map[string]string{
+				"/octoblu/service-b/image":       "octoblu/service-b:v1",
+				"/octoblu/service-b/deployed-by": "deploy-1 on super of octoblu/service-b",
+				"/octoblu/service-b/restart":     "v1",
+			}))
+		})
+
+		It("Should skip it once the first key holds the docker url", func() {
+			queue.Enqueue("deploy-2", time.Unix(1000, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-b", DockerURL: "octoblu/service-b:v1"})
+			Expect(sut.Run()).To(BeNil())
+			fields, _ := queue.InspectDeploy("deploy-2")
+			Expect(fields["skipped:reason"]).To(Equal("image is already octoblu/service-b:v1"))
+		})
+	})
+
+	Describe("When the etcdDir has no layout of its own", func() {
+		BeforeEach(func() {
+			queue.Enqueue("deploy-1", time.Unix(1000, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1"})
+			err = sut.Run()
+		})
+
+		It("Should write the default keys", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v1"))
+			Expect(etcdClient.Values["/octoblu/service-a/env/SENTRY_RELEASE"]).To(Equal("v1"))
+			Expect(etcdClient.Values["/octoblu/service-a/restart"]).NotTo(BeEmpty())
+		})
+	})
+
+	Describe("When a one key layout deploys env changes", func() {
+		BeforeEach(func() {
+			single, _ := deployer.NewKeyLayout([]deployer.KeyTemplate{{Key: "{{.EtcdDir}}/image", Value: "{{.DockerURL}}"}})
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{
+				KeyLayouts: &deployer.KeyLayouts{Default: single},
+			})
+			etcdClient.Values = map[string]string{
+				"/octoblu/service-a/image":      "octoblu/service-a:v0",
+				"/octoblu/service-a/env/SECRET": "old-secret",
+			}
+			queue.Enqueue("deploy-1", time.Unix(1000, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1", Env: map[string]string{"SECRET": "new-secret"}})
+			err = sut.Run()
+		})
+
+		It("Should write the env before the only key", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(Equal([][]string{
+				{"/octoblu/service-a/env/SECRET", "new-secret"},
+				{"/octoblu/service-a/image", "octoblu/service-a:v1"},
+			}))
+		})
+
+		It("Should record the docker url it replaced, not the env", func() {
+			releases, _ := queue.Releases("/octoblu/service-a")
+			Expect(releases).To(HaveLen(1))
+			Expect(releases[0].PreviousDockerURL).To(Equal("octoblu/service-a:v0"))
+			Expect(releases[0].PreviousRelease).To(Equal("v0"))
+		})
+	})
+
+	Describe("NewKeyLayout", func() {
+		It("Should refuse a layout whose first key is not the docker url", func() {
+			_, err := deployer.NewKeyLayout([]deployer.KeyTemplate{{Key: "{{.EtcdDir}}/tag", Value: "{{.Tag}}"}})
+			Expect(err).To(MatchError("The first key of a layout has to hold the docker url, '/octoblu/example/tag' holds 'v1.0.0'"))
+		})
+
+		It("Should refuse a template using unknown data", func() {
+			_, err := deployer.NewKeyLayout([]deployer.KeyTemplate{{Key: "{{.EtcdDir}}/docker_url", Value: "{{.Version}}"}})
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
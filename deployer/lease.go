@@ -0,0 +1,63 @@
+package deployer
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// lostLeaseError stops a deploy whose lease ran out, it was recovered and
+// may be deployed by another governator by now, so this one leaves it be
+type lostLeaseError struct {
+	deploy string
+}
+
+func (err *lostLeaseError) Error() string {
+	return fmt.Sprintf("Deploy '%v' is no longer in flight under this governator, its lease ran out", err.deploy)
+}
+
+// renewScript extends the lease of a deploy, but only while it is still
+// in flight and claimed by this instance. It returns 0 otherwise
+//
+// KEYS[1] inflight zset, KEYS[2] deploy hash
+// ARGV[1] lease deadline, ARGV[2] deploy, ARGV[3] instance id
+var renewScript = redis.NewScript(2, `
+if not redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+  return 0
+end
+
+if redis.call('HGET', KEYS[2], 'claimed:by') ~= ARGV[3] then
+  return 0
+end
+
+redis.call('ZADD', KEYS[1], 'XX', ARGV[1], ARGV[2])
+return 1
+`)
+
+// Renew extends the lease of a deploy claimed by this instance
+func (queue *RedisQueue) Renew(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	return queue.renew(redisConn, deploy)
+}
+
+func (queue *RedisQueue) renew(redisConn redis.Conn, deploy string) error {
+	deadline := queue.clock.Now().Add(queue.leaseDuration).Unix()
+	renewed, err := redis.Int(renewScript.Do(
+		redisConn,
+		queue.getKey("governator:inflight"),
+		queue.getKey(deploy),
+		deadline,
+		deploy,
+		queue.instanceID,
+	))
+	if err != nil {
+		return err
+	}
+
+	if renewed == 0 {
+		return &lostLeaseError{deploy: deploy}
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is a Queue that lives in memory and keeps the same fields
+// as the deploy hashes of a RedisQueue. Together with a ManualClock it
+// can drive a deployer through time without a redis server
+type MemoryQueue struct {
+	pending            map[string]time.Time
+	urgent             map[string]time.Time
+	inflight           map[string]time.Time
+	deadLetters        map[string]time.Time
+	fields             map[string]map[string]string
+	applied            map[string]string
+	pauses             map[string]memoryPause
+	releases           map[string][]*Release
+	instanceID         string
+	leaseDuration      time.Duration
+	maxLeaseRecoveries int
+	maxAttempts        int
+	retryBackoff       time.Duration
+	maxNormalDelay     time.Duration
+	clock              Clock
+	mutex              sync.Mutex
+}
+
+// memoryPause is a pause with its reason, it ends at until unless that is zero
+type memoryPause struct {
+	reason string
+	until  time.Time
+}
+
+// NewMemoryQueue constructs an empty queue, options may be nil
+func NewMemoryQueue(options *QueueOptions) *MemoryQueue {
+	if options == nil {
+		options = &QueueOptions{}
+	}
+
+	return &MemoryQueue{
+		pending:            make(map[string]time.Time),
+		urgent:             make(map[string]time.Time),
+		inflight:           make(map[string]time.Time),
+		deadLetters:        make(map[string]time.Time),
+		fields:             make(map[string]map[string]string),
+		applied:            make(map[string]string),
+		pauses:             make(map[string]memoryPause),
+		releases:           make(map[string][]*Release),
+		instanceID:         options.getInstanceID(),
+		leaseDuration:      options.getLeaseDuration(),
+		maxLeaseRecoveries: options.getMaxLeaseRecoveries(),
+		maxAttempts:        options.getMaxAttempts(),
+		retryBackoff:       options.getRetryBackoff(),
+		maxNormalDelay:     options.getMaxNormalDelay(),
+		clock:              options.getClock(),
+	}
+}
+
+// Enqueue schedules a deploy the way governator-service does
+func (queue *MemoryQueue) Enqueue(deploy string, dueAt time.Time, metadata *RequestMetadata) error {
+	return queue.enqueue(queue.pending, deploy, dueAt, metadata)
+}
+
+// EnqueueUrgent schedules a deploy in the urgent lane
+func (queue *MemoryQueue) EnqueueUrgent(deploy string, dueAt time.Time, metadata *RequestMetadata) error {
+	return queue.enqueue(queue.urgent, deploy, dueAt, metadata)
+}
+
+func (queue *MemoryQueue) enqueue(lane map[string]time.Time, deploy string, dueAt time.Time, metadata *RequestMetadata) error {
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.set(deploy, "request:metadata", string(metadataBytes))
+	lane[deploy] = dueAt
+	return nil
+}
+
+// Cancel records a cancellation for the deploy
+func (queue *MemoryQueue) Cancel(deploy string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.set(deploy, "cancellation", strconv.FormatInt(queue.clock.Now().Unix(), 10))
+}
+
+// Pause pauses deploys for the whole queue with an empty etcdDir, otherwise
+// for that etcdDir. The pause ends by itself after ttl unless ttl is zero
+func (queue *MemoryQueue) Pause(etcdDir, reason string, ttl time.Duration) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pause := memoryPause{reason: reason}
+	if ttl > 0 {
+		pause.until = queue.clock.Now().Add(ttl)
+	}
+	queue.pauses[etcdDir] = pause
+	return nil
+}
+
+// Resume ends a pause and tells whether there was one
+func (queue *MemoryQueue) Resume(etcdDir string) (bool, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	_, paused := queue.pauses[etcdDir]
+	delete(queue.pauses, etcdDir)
+	return paused, nil
+}
+
+// DeadLetters lists the deploys that ran out of attempts, oldest first
+func (queue *MemoryQueue) DeadLetters() ([]string, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return sortedDeploys(queue.deadLetters), nil
+}
+
+// InspectDeploy returns every field of a deploy
+func (queue *MemoryQueue) InspectDeploy(deploy string) (map[string]string, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	fields, ok := queue.fields[deploy]
+	if !ok {
+		return nil, fmt.Errorf("Deploy not found: '%v'", deploy)
+	}
+
+	copied := make(map[string]string, len(fields))
+	for name, value := range fields {
+		copied[name] = value
+	}
+	return copied, nil
+}
+
+// NextDue returns the earliest scheduled deploy of either lane and when it is due
+func (queue *MemoryQueue) NextDue() (string, time.Time, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	scheduled := make(map[string]time.Time, len(queue.pending)+len(queue.urgent))
+	for deploy, dueAt := range queue.pending {
+		scheduled[deploy] = dueAt
+	}
+	for deploy, dueAt := range queue.urgent {
+		scheduled[deploy] = dueAt
+	}
+
+	deploys := sortedDeploys(scheduled)
+	if len(deploys) == 0 {
+		return "", time.Time{}, nil
+	}
+
+	return deploys[0], scheduled[deploys[0]], nil
+}
+
+// Claim takes the first due deploy off the queue and puts it in flight
+func (queue *MemoryQueue) Claim() (*Claim, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := queue.clock.Now()
+	deploy, lane := queue.firstDue(now)
+	if deploy == "" {
+		return nil, nil
+	}
+
+	var dueAt time.Time
+	if lane == "urgent" {
+		dueAt = queue.urgent[deploy]
+		delete(queue.urgent, deploy)
+	} else {
+		dueAt = queue.pending[deploy]
+		delete(queue.pending, deploy)
+	}
+
+	if queue.has(deploy, "cancellation") {
+		debug("Deploy was cancelled: %v", deploy)
+		queue.setStatus(deploy, StatusSkipped, "finished:at", unixString(now))
+		return &Claim{Deploy: deploy, Cancelled: true}, nil
+	}
+
+	metadata, err := queue.metadata(deploy)
+	if err != nil {
+		return nil, err
+	}
+
+	debug("claimed: %v", deploy)
+	queue.inflight[deploy] = now.Add(queue.leaseDuration)
+	queue.setStatus(deploy, StatusClaimed, "claimed:by", queue.instanceID, "claimed:at", unixString(now), "lane", lane)
+	if !queue.has(deploy, "due:at") {
+		queue.set(deploy, "due:at", unixString(dueAt))
+	}
+
+	dueAt, err = parseScore(queue.fields[deploy]["due:at"])
+	if err != nil {
+		return nil, err
+	}
+	return &Claim{Deploy: deploy, Metadata: metadata, DueAt: dueAt, Restarted: queue.has(deploy, "restarted:at")}, nil
+}
+
+// IsCancelled tells whether a cancellation was recorded for the deploy
+func (queue *MemoryQueue) IsCancelled(deploy string) (bool, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.has(deploy, "cancellation"), nil
+}
+
+// Metadata returns the request metadata of a deploy
+func (queue *MemoryQueue) Metadata(deploy string) (*RequestMetadata, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.metadata(deploy)
+}
+
+// Applied returns the outcome of the last time the deploy was applied
+func (queue *MemoryQueue) Applied(deploy string) (string, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.applied[deploy], nil
+}
+
+// Renew extends the lease of a deploy claimed by this instance
+func (queue *MemoryQueue) Renew(deploy string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.renew(deploy)
+}
+
+func (queue *MemoryQueue) renew(deploy string) error {
+	if _, ok := queue.inflight[deploy]; !ok || queue.fields[deploy]["claimed:by"] != queue.instanceID {
+		return &lostLeaseError{deploy: deploy}
+	}
+
+	queue.inflight[deploy] = queue.clock.Now().Add(queue.leaseDuration)
+	return nil
+}
+
+// Start renews the lease of an in flight deploy
+// and records that it is being deployed
+func (queue *MemoryQueue) Start(deploy string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	err := queue.renew(deploy)
+	if err != nil {
+		return err
+	}
+
+	queue.applied[deploy] = StatusDeploying
+	queue.setStatus(deploy, StatusDeploying)
+	return nil
+}
+
+// RecordRestart records that every key of the deploy was written
+func (queue *MemoryQueue) RecordRestart(deploy string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.set(deploy, "restarted:at", unixString(queue.clock.Now()))
+	return nil
+}
+
+// Ack records how an in flight deploy finished and takes it out of flight
+func (queue *MemoryQueue) Ack(deploy, status string, fields ...string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	debug("ack: %v %v", deploy, status)
+	queue.setStatus(deploy, status, append([]string{"finished:at", unixString(queue.clock.Now())}, fields...)...)
+	if status == StatusDone || status == StatusCancelled {
+		queue.applied[deploy] = status
+	}
+	delete(queue.inflight, deploy)
+	return nil
+}
+
+// Fail records a failed attempt and schedules the deploy again with
+// exponential backoff, or dead letters it once it ran out of attempts
+func (queue *MemoryQueue) Fail(deploy string, cause error) (time.Time, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := queue.clock.Now()
+	attempts := queue.increment(deploy, "attempts")
+
+	retryAt := now
+	if attempts >= queue.maxAttempts {
+		log.Printf("deploy %v failed %v times, dead lettering it: %v", deploy, attempts, cause)
+		queue.setStatus(deploy, StatusFailed, "finished:at", unixString(now), "error", cause.Error())
+		queue.applied[deploy] = StatusFailed
+		queue.deadLetters[deploy] = now
+	} else {
+		retryAt = now.Add(getRetryDelay(queue.retryBackoff, attempts))
+		log.Printf("deploy %v failed (attempt %v of %v), retrying at %v: %v", deploy, attempts, queue.maxAttempts, retryAt, cause)
+		queue.setStatus(deploy, StatusRetrying, "error", cause.Error())
+		queue.applied[deploy] = StatusRetrying
+		queue.getLane(deploy)[deploy] = retryAt
+	}
+
+	delete(queue.inflight, deploy)
+	return retryAt, nil
+}
+
+// Requeue puts an in flight deploy back on the queue without counting an attempt
+func (queue *MemoryQueue) Requeue(deploy string, dueAt time.Time) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	debug("requeue: %v", deploy)
+	queue.getLane(deploy)[deploy] = dueAt
+	delete(queue.inflight, deploy)
+	queue.setStatus(deploy, StatusPending)
+	return nil
+}
+
+// Paused tells whether deploys are paused, along with the reason given
+func (queue *MemoryQueue) Paused(etcdDir string) (bool, string, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pause, paused := queue.pauses[etcdDir]
+	if paused && !pause.until.IsZero() && !pause.until.After(queue.clock.Now()) {
+		delete(queue.pauses, etcdDir)
+		return false, "", nil
+	}
+	return paused, pause.reason, nil
+}
+
+// RecordRelease adds a release to the history of an etcdDir
+func (queue *MemoryQueue) RecordRelease(etcdDir string, release *Release) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	releases := append([]*Release{release}, queue.releases[etcdDir]...)
+	if len(releases) > maxReleases {
+		releases = releases[:maxReleases]
+	}
+	queue.releases[etcdDir] = releases
+	return nil
+}
+
+// Releases returns the history of an etcdDir, newest first
+func (queue *MemoryQueue) Releases(etcdDir string) ([]*Release, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return append([]*Release(nil), queue.releases[etcdDir]...), nil
+}
+
+// Recover requeues the in flight deploys whose lease ran out
+func (queue *MemoryQueue) Recover() error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := queue.clock.Now()
+	for _, deploy := range sortedDeploys(queue.inflight) {
+		if queue.inflight[deploy].After(now) {
+			break
+		}
+
+		debug("recoverDeploy: %v", deploy)
+		delete(queue.inflight, deploy)
+
+		if !queue.has(deploy, "request:metadata") {
+			debug("Dropping abandoned deploy without metadata: %v", deploy)
+			continue
+		}
+
+		recoveries := queue.increment(deploy, "lease:recoveries")
+		if recoveries > queue.maxLeaseRecoveries {
+			debug("Deploy abandoned too many times, marking failed: %v", deploy)
+			errorMessage := fmt.Sprintf("lease expired %v times", recoveries)
+			queue.setStatus(deploy, StatusFailed, "finished:at", unixString(now), "error", errorMessage)
+			continue
+		}
+
+		debug("Requeueing abandoned deploy: %v", deploy)
+		queue.getLane(deploy)[deploy] = now
+		queue.setStatus(deploy, StatusPending)
+	}
+
+	return nil
+}
+
+// firstDue picks the deploy to claim the way the redis claim script does,
+// urgent deploys go first unless a normal one is due for too long
+func (queue *MemoryQueue) firstDue(now time.Time) (string, string) {
+	var normal, urgent string
+
+	if deploys := sortedDeploys(queue.pending); len(deploys) > 0 && !queue.pending[deploys[0]].After(now) {
+		normal = deploys[0]
+	}
+
+	if deploys := sortedDeploys(queue.urgent); len(deploys) > 0 && !queue.urgent[deploys[0]].After(now) {
+		urgent = deploys[0]
+	}
+
+	starving := normal != "" && !queue.pending[normal].After(now.Add(-queue.maxNormalDelay))
+	if urgent != "" && !starving {
+		return urgent, "urgent"
+	}
+	return normal, "normal"
+}
+
+// getLane returns the lane the deploy was claimed from
+func (queue *MemoryQueue) getLane(deploy string) map[string]time.Time {
+	if queue.fields[deploy]["lane"] == "urgent" {
+		return queue.urgent
+	}
+	return queue.pending
+}
+
+func (queue *MemoryQueue) metadata(deploy string) (*RequestMetadata, error) {
+	if !queue.has(deploy, "request:metadata") {
+		return nil, fmt.Errorf("Deploy metadata not found for '%v'", deploy)
+	}
+
+	var metadata RequestMetadata
+	err := json.Unmarshal([]byte(queue.fields[deploy]["request:metadata"]), &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+func (queue *MemoryQueue) setStatus(deploy, status string, fields ...string) {
+	queue.set(deploy, "status", status)
+	for index := 0; index+1 < len(fields); index += 2 {
+		queue.set(deploy, fields[index], fields[index+1])
+	}
+}
+
+func (queue *MemoryQueue) increment(deploy, name string) int {
+	value, _ := strconv.Atoi(queue.fields[deploy][name])
+	value++
+	queue.set(deploy, name, strconv.Itoa(value))
+	return value
+}
+
+func (queue *MemoryQueue) has(deploy, name string) bool {
+	_, ok := queue.fields[deploy][name]
+	return ok
+}
+
+func (queue *MemoryQueue) set(deploy, name, value string) {
+	if queue.fields[deploy] == nil {
+		queue.fields[deploy] = make(map[string]string)
+	}
+	queue.fields[deploy][name] = value
+}
+
+// sortedDeploys orders deploys by time and then by name, like a redis zset
+func sortedDeploys(scores map[string]time.Time) []string {
+	deploys := make([]string, 0, len(scores))
+	for deploy := range scores {
+		deploys = append(deploys, deploy)
+	}
+
+	sort.Slice(deploys, func(i, j int) bool {
+		left, right := scores[deploys[i]], scores[deploys[j]]
+		if left.Equal(right) {
+			return deploys[i] < deploys[j]
+		}
+		return left.Before(right)
+	})
+	return deploys
+}
+
+func unixString(moment time.Time) string {
+	return strconv.FormatInt(moment.Unix(), 10)
+}
@@ -0,0 +1,796 @@
+package deployer_test
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/octoblu/governator/deployer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryQueue", func() {
+	var sut *deployer.Deployer
+	var queue *deployer.MemoryQueue
+	var clock *deployer.ManualClock
+	var etcdClient *FakeEtcdClient
+	var err error
+
+	BeforeEach(func() {
+		httpmock.Activate()
+		rsp := httpmock.NewStringResponder(200, "Ok")
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/passed", rsp)
+
+		clock = deployer.NewManualClock(time.Unix(1000, 0))
+		queue = deployer.NewMemoryQueue(&deployer.QueueOptions{
+			InstanceID:   "governator-1",
+			MaxAttempts:  2,
+			RetryBackoff: 10 * time.Second,
+			Clock:        clock,
+		})
+		etcdClient = &FakeEtcdClient{}
+		sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock})
+
+		queue.Enqueue("deploy-1", time.Unix(1060, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1"})
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	Describe("When the deploy is not due yet", func() {
+		var wait time.Duration
+
+		BeforeEach(func() {
+			err = sut.Run()
+			wait, _ = sut.NextDeployIn(time.Minute)
+		})
+
+		It("Should not deploy", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+		})
+
+		It("Should wait until it is due", func() {
+			Expect(wait).To(Equal(60 * time.Second))
+		})
+	})
+
+	Describe("When the deploy is due", func() {
+		var fields map[string]string
+
+		BeforeEach(func() {
+			clock.Advance(time.Minute)
+			err = sut.Run()
+			fields, _ = queue.InspectDeploy("deploy-1")
+		})
+
+		It("Should deploy it", func() {
+			Expect(err).To(BeNil())
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-a")).To(Equal([]string{"octoblu/service-a:v1"}))
+		})
+
+		It("Should record it as done", func() {
+			Expect(fields["status"]).To(Equal("done"))
+			Expect(fields["claimed:by"]).To(Equal("governator-1"))
+			Expect(fields["finished:at"]).To(Equal("1060"))
+		})
+
+		It("Should count it as done", func() {
+			Expect(sut.Counts()).To(Equal(map[string]int{"done": 1}))
+		})
+	})
+
+	Describe("When the deploy was cancelled", func() {
+		var fields map[string]string
+
+		BeforeEach(func() {
+			queue.Cancel("deploy-1")
+			clock.Advance(time.Minute)
+			err = sut.Run()
+			fields, _ = queue.InspectDeploy("deploy-1")
+		})
+
+		It("Should skip it", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+			Expect(fields["status"]).To(Equal("skipped"))
+		})
+	})
+
+	Describe("When the deploy is cancelled while in flight", func() {
+		var fields map[string]string
+
+		BeforeEach(func() {
+			etcdClient.OnSet = func(key string) {
+				if key == "/octoblu/service-a/env/SENTRY_RELEASE" {
+					queue.Cancel("deploy-1")
+				}
+			}
+			clock.Advance(time.Minute)
+			err = sut.Run()
+			fields, _ = queue.InspectDeploy("deploy-1")
+		})
+
+		It("Should stop before touching restart", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(2))
+		})
+
+		It("Should record it as cancelled along with how far it got", func() {
+			Expect(fields["status"]).To(Equal("cancelled"))
+			Expect(fields["cancelled:after"]).To(Equal("env/SENTRY_RELEASE"))
+		})
+	})
+
+	Describe("When the deploy is cancelled once restart was touched", func() {
+		BeforeEach(func() {
+			etcdClient.OnSet = func(key string) {
+				if key == "/octoblu/service-a/restart" {
+					queue.Cancel("deploy-1")
+				}
+			}
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should finish the deploy, the service runs it already", func() {
+			Expect(err).To(BeNil())
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("done"))
+
+			releases, _ := queue.Releases("/octoblu/service-a")
+			Expect(releases).To(HaveLen(1))
+		})
+	})
+
+	Describe("When the deploy is enqueued again after it succeeded", func() {
+		var fields map[string]string
+
+		BeforeEach(func() {
+			clock.Advance(time.Minute)
+			sut.Run()
+			queue.Enqueue("deploy-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1", ForceRestart: true})
+			err = sut.Run()
+			fields, _ = queue.InspectDeploy("deploy-1")
+		})
+
+		It("Should not apply it twice", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(3))
+		})
+
+		It("Should record why it was skipped", func() {
+			Expect(fields["status"]).To(Equal("skipped"))
+			Expect(fields["skipped:reason"]).To(Equal("already applied"))
+		})
+	})
+
+	Describe("When the etcdDir already runs the docker url", func() {
+		BeforeEach(func() {
+			etcdClient.Values = map[string]string{"/octoblu/service-a/docker_url": "octoblu/service-a:v1"}
+			clock.Advance(time.Minute)
+		})
+
+		It("Should skip the deploy", func() {
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["skipped:reason"]).To(Equal("docker_url is already octoblu/service-a:v1"))
+		})
+
+		It("Should deploy it anyway when it forces a restart", func() {
+			queue.Enqueue("deploy-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1", ForceRestart: true})
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(3))
+		})
+
+		It("Should retry it when an earlier attempt wrote the docker url", func() {
+			queue.Claim()
+			queue.Start("deploy-1")
+			retryAt, _ := queue.Fail("deploy-1", fmt.Errorf("etcd is gone"))
+
+			clock.Advance(retryAt.Sub(clock.Now()))
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(3))
+		})
+
+		It("Should retry it when etcd cannot tell what the etcdDir runs", func() {
+			etcdClient.GetError = fmt.Errorf("etcd is gone")
+			Expect(sut.Run()).To(BeNil())
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("retrying"))
+			Expect(fields["attempts"]).To(Equal("1"))
+			Expect(fields["error"]).To(Equal("etcd is gone"))
+		})
+	})
+
+	Describe("When the deploy is claimed past its deadline", func() {
+		var reports int
+		var fields map[string]string
+
+		BeforeEach(func() {
+			reports = 0
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/failed", func(*http.Request) (*http.Response, error) {
+				reports++
+				return httpmock.NewStringResponse(200, "Ok"), nil
+			})
+
+			queue.Enqueue("deploy-1", time.Unix(1060, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1", Deadline: 1100})
+			clock.Advance(2 * time.Minute)
+			err = sut.Run()
+			fields, _ = queue.InspectDeploy("deploy-1")
+		})
+
+		It("Should not roll it out", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+		})
+
+		It("Should record it as expired", func() {
+			Expect(fields["status"]).To(Equal("expired"))
+			Expect(fields["expired:at"]).To(Equal("1100"))
+		})
+
+		It("Should report it to deploy-state as failed", func() {
+			Expect(reports).To(Equal(1))
+		})
+	})
+
+	Describe("When the deploy is later than the max lateness", func() {
+		BeforeEach(func() {
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/failed", httpmock.NewStringResponder(200, "Ok"))
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, MaxLateness: time.Hour})
+		})
+
+		It("Should still roll it out within the max lateness", func() {
+			clock.Advance(time.Hour)
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(3))
+		})
+
+		It("Should expire it after the max lateness", func() {
+			clock.Advance(2 * time.Hour)
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("expired"))
+			Expect(fields["expired:at"]).To(Equal("4660"))
+		})
+
+		It("Should not roll it out later when deploy-state fails", func() {
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/failed", httpmock.NewStringResponder(500, "Oops"))
+			clock.Advance(3 * time.Hour)
+			Expect(sut.Run()).To(BeNil())
+			clock.Advance(time.Hour)
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("expired"))
+		})
+	})
+
+	Describe("When a held deploy is resumed past its max lateness", func() {
+		BeforeEach(func() {
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/failed", httpmock.NewStringResponder(200, "Ok"))
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, MaxLateness: time.Minute})
+			queue.Pause("/octoblu/service-a", "", 0)
+			clock.Advance(time.Minute)
+			sut.Run()
+
+			clock.Advance(time.Hour)
+			sut.Run()
+
+			clock.Advance(20 * time.Second)
+			queue.Resume("/octoblu/service-a")
+			err = sut.Run()
+		})
+
+		It("Should count the lateness from when it was due, not from the hold", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("expired"))
+			Expect(fields["due:at"]).To(Equal("1060"))
+		})
+	})
+
+	Describe("When the queue is paused", func() {
+		var wait time.Duration
+
+		BeforeEach(func() {
+			queue.Pause("", "incident 42", 5*time.Minute)
+			clock.Advance(time.Minute)
+			err = sut.Run()
+			wait, _ = sut.NextDeployIn(time.Minute)
+		})
+
+		It("Should not deploy", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+		})
+
+		It("Should leave the deploy queued", func() {
+			deploy, _, _ := queue.NextDue()
+			Expect(deploy).To(Equal("deploy-1"))
+		})
+
+		It("Should tell it is paused and why", func() {
+			paused, reason := sut.Paused()
+			Expect(paused).To(BeTrue())
+			Expect(reason).To(Equal("incident 42"))
+		})
+
+		It("Should look again soon", func() {
+			Expect(wait).To(Equal(10 * time.Second))
+		})
+
+		It("Should deploy once resumed", func() {
+			queue.Resume("")
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(3))
+		})
+
+		It("Should deploy once the pause expired", func() {
+			clock.Advance(5 * time.Minute)
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(HaveLen(3))
+
+			paused, _ := sut.Paused()
+			Expect(paused).To(BeFalse())
+		})
+	})
+
+	Describe("When the etcdDir of the deploy is paused", func() {
+		BeforeEach(func() {
+			queue.Pause("/octoblu/service-a", "", 0)
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should hold the deploy back", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			deploy, dueAt, _ := queue.NextDue()
+			Expect(deploy).To(Equal("deploy-1"))
+			Expect(dueAt).To(Equal(time.Unix(1071, 0)))
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("pending"))
+		})
+
+		It("Should keep deploying other etcdDirs", func() {
+			queue.Enqueue("deploy-2", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-b", DockerURL: "octoblu/service-b:v1"})
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-b/v1/cluster/super/passed", httpmock.NewStringResponder(200, "Ok"))
+			Expect(sut.Run()).To(BeNil())
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-b")).To(Equal([]string{"octoblu/service-b:v1"}))
+		})
+	})
+
+	Describe("When restart cannot be written", func() {
+		BeforeEach(func() {
+			etcdClient.Values = map[string]string{
+				"/octoblu/service-a/docker_url":         "octoblu/service-a:v0",
+				"/octoblu/service-a/env/SENTRY_RELEASE": "v0",
+			}
+			etcdClient.KeyErrors = map[string]error{"/octoblu/service-a/restart": fmt.Errorf("etcd is gone")}
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should put the old docker url and release back", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.Values).To(Equal(map[string]string{
+				"/octoblu/service-a/docker_url":         "octoblu/service-a:v0",
+				"/octoblu/service-a/env/SENTRY_RELEASE": "v0",
+			}))
+		})
+
+		It("Should fail the deploy as a whole", func() {
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("retrying"))
+			Expect(fields["error"]).To(Equal("etcd is gone"))
+		})
+	})
+
+	Describe("When a key changes while deploying", func() {
+		BeforeEach(func() {
+			etcdClient.OnSet = func(key string) {
+				if key == "/octoblu/service-a/env/SENTRY_RELEASE" {
+					etcdClient.Values[key] = "someone else"
+				}
+			}
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should not overwrite it", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.Values).To(Equal(map[string]string{"/octoblu/service-a/env/SENTRY_RELEASE": "someone else"}))
+		})
+
+		It("Should fail the deploy", func() {
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["error"]).To(Equal("etcd key /octoblu/service-a/env/SENTRY_RELEASE changed meanwhile"))
+		})
+	})
+
+	Describe("When the deploy carries env changes", func() {
+		BeforeEach(func() {
+			etcdClient.Values = map[string]string{
+				"/octoblu/service-a/docker_url":   "octoblu/service-a:v1",
+				"/octoblu/service-a/env/OLD_FLAG": "on",
+			}
+			queue.Enqueue("deploy-2", time.Unix(1060, 0), &deployer.RequestMetadata{
+				EtcdDir:   "/octoblu/service-a",
+				DockerURL: "octoblu/service-a:v1",
+				Env:       map[string]string{"DATABASE_PASSWORD": "hunter2", "API_URL": "https://api.test"},
+				UnsetEnv:  []string{"OLD_FLAG"},
+			})
+			queue.Cancel("deploy-1")
+			clock.Advance(time.Minute)
+			sut.Run()
+			err = sut.Run()
+		})
+
+		It("Should not skip it for its docker url", func() {
+			Expect(err).To(BeNil())
+			fields, _ := queue.InspectDeploy("deploy-2")
+			Expect(fields["status"]).To(Equal("done"))
+		})
+
+		It("Should write and remove the env keys before restart", func() {
+			var keys []string
+			for _, call := range etcdClient.SetCalls {
+				keys = append(keys, call[0])
+			}
+			Expect(keys).To(Equal([]string{
+				"/octoblu/service-a/docker_url",
+				"/octoblu/service-a/env/SENTRY_RELEASE",
+				"/octoblu/service-a/env/API_URL",
+				"/octoblu/service-a/env/DATABASE_PASSWORD",
+				"/octoblu/service-a/restart",
+			}))
+			Expect(etcdClient.DeleteCalls).To(Equal([]string{"/octoblu/service-a/env/OLD_FLAG"}))
+			Expect(etcdClient.Values["/octoblu/service-a/env/DATABASE_PASSWORD"]).To(Equal("hunter2"))
+			Expect(etcdClient.Values).NotTo(HaveKey("/octoblu/service-a/env/OLD_FLAG"))
+		})
+
+		It("Should redact the env values", func() {
+			fields, _ := queue.InspectDeploy("deploy-2")
+			Expect(deployer.RedactRequestMetadata(fields["request:metadata"])).NotTo(ContainSubstring("hunter2"))
+			Expect(deployer.RedactRequestMetadata(fields["request:metadata"])).To(ContainSubstring(`"DATABASE_PASSWORD":"[redacted]"`))
+		})
+	})
+
+	Describe("When a deploy carrying env changes is superseded", func() {
+		BeforeEach(func() {
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v2/cluster/super/passed", httpmock.NewStringResponder(200, "Ok"))
+			queue.Enqueue("deploy-2", time.Unix(1060, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1", Env: map[string]string{"FLAG": "on"}})
+			queue.Enqueue("deploy-3", time.Unix(1060, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v2"})
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, Supersede: true})
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should still deploy its env changes", func() {
+			Expect(err).To(BeNil())
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("superseded"))
+			fields, _ = queue.InspectDeploy("deploy-2")
+			Expect(fields["status"]).To(Equal("done"))
+			Expect(etcdClient.Values["/octoblu/service-a/env/FLAG"]).To(Equal("on"))
+			Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v2"))
+		})
+	})
+
+	Describe("When the deploy sets an env the key layout writes", func() {
+		BeforeEach(func() {
+			queue.Cancel("deploy-1")
+			queue.Enqueue("deploy-2", time.Unix(1060, 0), &deployer.RequestMetadata{
+				EtcdDir:   "/octoblu/service-a",
+				DockerURL: "octoblu/service-a:v1",
+				Env:       map[string]string{"SENTRY_RELEASE": "v0"},
+			})
+			clock.Advance(time.Minute)
+			sut.Run()
+			err = sut.Run()
+		})
+
+		It("Should fail it without writing anything", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.Values).To(BeEmpty())
+			fields, _ := queue.InspectDeploy("deploy-2")
+			Expect(fields["error"]).To(Equal("Env SENTRY_RELEASE is written by the key layout already"))
+		})
+	})
+
+	Describe("When the deploy sets and unsets the same env", func() {
+		BeforeEach(func() {
+			queue.Cancel("deploy-1")
+			queue.Enqueue("deploy-2", time.Unix(1060, 0), &deployer.RequestMetadata{
+				EtcdDir:   "/octoblu/service-a",
+				DockerURL: "octoblu/service-a:v1",
+				Env:       map[string]string{"FLAG": "on"},
+				UnsetEnv:  []string{"FLAG"},
+			})
+			clock.Advance(time.Minute)
+			sut.Run()
+			err = sut.Run()
+		})
+
+		It("Should fail it without writing anything", func() {
+			Expect(err).To(BeNil())
+			Expect(etcdClient.Values).To(BeEmpty())
+			fields, _ := queue.InspectDeploy("deploy-2")
+			Expect(fields["error"]).To(Equal("Env FLAG is both set and unset"))
+		})
+	})
+
+	Describe("When the deploy replaced an earlier release", func() {
+		BeforeEach(func() {
+			etcdClient.Values = map[string]string{
+				"/octoblu/service-a/docker_url":         "octoblu/service-a:v0",
+				"/octoblu/service-a/env/SENTRY_RELEASE": "v0",
+			}
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should record the release along with what it replaced", func() {
+			Expect(err).To(BeNil())
+			releases, _ := queue.Releases("/octoblu/service-a")
+			Expect(releases).To(Equal([]*deployer.Release{{
+				Deploy:            "deploy-1",
+				DockerURL:         "octoblu/service-a:v1",
+				Release:           "v1",
+				DeployedAt:        1060,
+				PreviousDockerURL: "octoblu/service-a:v0",
+				PreviousRelease:   "v0",
+				DueAt:             1060,
+			}}))
+		})
+
+		Describe("When it is rolled back", func() {
+			var rolledBack bool
+
+			BeforeEach(func() {
+				rolledBack = false
+				httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v0/cluster/super/passed", func(*http.Request) (*http.Response, error) {
+					rolledBack = true
+					return httpmock.NewStringResponse(200, "Ok"), nil
+				})
+				queue.EnqueueUrgent("rollback-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", Type: deployer.RequestTypeRollback})
+				err = sut.Run()
+			})
+
+			It("Should deploy the previous docker url and release", func() {
+				Expect(err).To(BeNil())
+				Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v0"))
+				Expect(etcdClient.Values["/octoblu/service-a/env/SENTRY_RELEASE"]).To(Equal("v0"))
+				Expect(etcdClient.Values["/octoblu/service-a/restart"]).NotTo(BeEmpty())
+			})
+
+			It("Should notify deploy-state", func() {
+				Expect(rolledBack).To(BeTrue())
+			})
+
+			It("Should record the rollback as a release", func() {
+				releases, _ := queue.Releases("/octoblu/service-a")
+				Expect(releases[0].Deploy).To(Equal("rollback-1"))
+				Expect(releases[0].PreviousDockerURL).To(Equal("octoblu/service-a:v1"))
+				Expect(releases[0].Rollback).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("When reporting a deploy fails once", func() {
+		BeforeEach(func() {
+			reports := 0
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/passed", func(*http.Request) (*http.Response, error) {
+				reports++
+				if reports == 1 {
+					return httpmock.NewStringResponse(500, "Oops"), nil
+				}
+				return httpmock.NewStringResponse(200, "Ok"), nil
+			})
+			etcdClient.Values = map[string]string{"/octoblu/service-a/docker_url": "octoblu/service-a:v0"}
+			queue.RecordRelease("/octoblu/service-a", &deployer.Release{Deploy: "deploy-0", DockerURL: "octoblu/service-a:v0", Release: "v0"})
+
+			clock.Advance(time.Minute)
+			sut.Run()
+			clock.Advance(10 * time.Second)
+			err = sut.Run()
+		})
+
+		It("Should only report it again instead of restarting the service again", func() {
+			Expect(err).To(BeNil())
+			restarts := 0
+			for _, call := range etcdClient.SetCalls {
+				if call[0] == "/octoblu/service-a/restart" {
+					restarts++
+				}
+			}
+			Expect(restarts).To(Equal(1))
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("done"))
+		})
+
+		It("Should record what ran before the first attempt", func() {
+			Expect(err).To(BeNil())
+			releases, _ := queue.Releases("/octoblu/service-a")
+			Expect(releases).To(HaveLen(2))
+			Expect(releases[0].Deploy).To(Equal("deploy-1"))
+			Expect(releases[0].PreviousDockerURL).To(Equal("octoblu/service-a:v0"))
+		})
+	})
+
+	Describe("When an etcdDir without releases is rolled back", func() {
+		BeforeEach(func() {
+			queue.EnqueueUrgent("rollback-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-b", Type: deployer.RequestTypeRollback})
+			err = sut.Run()
+		})
+
+		It("Should fail the rollback", func() {
+			Expect(err).To(BeNil())
+			fields, _ := queue.InspectDeploy("rollback-1")
+			Expect(fields["error"]).To(Equal("Cannot roll /octoblu/service-b back: No releases recorded"))
+		})
+	})
+
+	Describe("When the deploy keeps failing", func() {
+		BeforeEach(func() {
+			etcdClient.SetError = fmt.Errorf("etcd is gone")
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should retry it after the backoff", func() {
+			Expect(err).To(BeNil())
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("retrying"))
+
+			deploy, dueAt, _ := queue.NextDue()
+			Expect(deploy).To(Equal("deploy-1"))
+			Expect(dueAt).To(Equal(time.Unix(1070, 0)))
+		})
+
+		It("Should dead letter it once it ran out of attempts", func() {
+			clock.Advance(10 * time.Second)
+			Expect(sut.Run()).To(BeNil())
+
+			deadLetters, _ := queue.DeadLetters()
+			Expect(deadLetters).To(Equal([]string{"deploy-1"}))
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("failed"))
+			Expect(fields["error"]).To(Equal("etcd is gone"))
+		})
+	})
+
+	Describe("When an urgent deploy is due as well", func() {
+		BeforeEach(func() {
+			queue.EnqueueUrgent("hotfix-1", time.Unix(1070, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-b", DockerURL: "octoblu/service-b:v2"})
+		})
+
+		It("Should claim the urgent deploy first", func() {
+			clock.Advance(2 * time.Minute)
+			claim, _ := queue.Claim()
+			Expect(claim.Deploy).To(Equal("hotfix-1"))
+		})
+
+		It("Should claim the normal deploy first once it waited too long", func() {
+			clock.Advance(time.Minute + deployer.DefaultMaxNormalDelay)
+			claim, _ := queue.Claim()
+			Expect(claim.Deploy).To(Equal("deploy-1"))
+		})
+
+		It("Should keep a failed urgent deploy in the urgent lane", func() {
+			clock.Advance(2 * time.Minute)
+			claim, _ := queue.Claim()
+			retryAt, _ := queue.Fail(claim.Deploy, fmt.Errorf("etcd is gone"))
+
+			clock.Advance(retryAt.Sub(clock.Now()))
+			claim, _ = queue.Claim()
+			Expect(claim.Deploy).To(Equal("hotfix-1"))
+		})
+	})
+
+	Describe("When an urgent deploy for the same etcdDir overtakes an older one", func() {
+		BeforeEach(func() {
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v2/cluster/super/passed", httpmock.NewStringResponder(200, "Ok"))
+			queue.EnqueueUrgent("hotfix-1", time.Unix(1070, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v2"})
+			clock.Advance(2 * time.Minute)
+		})
+
+		Describe("When they are deployed one at a time", func() {
+			BeforeEach(func() {
+				sut.Run()
+				err = sut.Run()
+			})
+
+			It("Should skip the older deploy instead of putting its docker url back", func() {
+				Expect(err).To(BeNil())
+				Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v2"))
+
+				fields, _ := queue.InspectDeploy("deploy-1")
+				Expect(fields["status"]).To(Equal("skipped"))
+				Expect(fields["skipped:reason"]).To(Equal("hotfix-1 was due later and went out already"))
+			})
+		})
+
+		Describe("When they are superseded", func() {
+			BeforeEach(func() {
+				sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, Supersede: true})
+				err = sut.Run()
+			})
+
+			It("Should supersede the older deploy with the urgent one", func() {
+				Expect(err).To(BeNil())
+				Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v2"))
+
+				fields, _ := queue.InspectDeploy("deploy-1")
+				Expect(fields["status"]).To(Equal("superseded"))
+				Expect(fields["superseded"]).To(Equal("hotfix-1"))
+			})
+		})
+	})
+
+	Describe("When the lease of the next deploy in a group runs out meanwhile", func() {
+		BeforeEach(func() {
+			queue.Enqueue("deploy-2", time.Unix(1060, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v2"})
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, Workers: 2})
+			etcdClient.OnSet = func(key string) {
+				if key == "/octoblu/service-a/restart" {
+					clock.Advance(deployer.DefaultLeaseDuration)
+					queue.Recover()
+				}
+			}
+			clock.Advance(time.Minute)
+			err = sut.Run()
+		})
+
+		It("Should leave it to whoever claims it next", func() {
+			Expect(err).To(MatchError("Deploy 'deploy-2' is no longer in flight under this governator, its lease ran out"))
+			Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v1"))
+
+			fields, _ := queue.InspectDeploy("deploy-2")
+			Expect(fields["status"]).To(Equal("pending"))
+		})
+	})
+
+	Describe("When the governator that claimed the deploy died", func() {
+		BeforeEach(func() {
+			clock.Advance(time.Minute)
+			queue.Claim()
+		})
+
+		It("Should not recover it while the lease holds", func() {
+			Expect(queue.Recover()).To(BeNil())
+			deploy, _, _ := queue.NextDue()
+			Expect(deploy).To(BeEmpty())
+		})
+
+		It("Should requeue it once the lease ran out", func() {
+			clock.Advance(deployer.DefaultLeaseDuration)
+			Expect(queue.Recover()).To(BeNil())
+
+			deploy, _, _ := queue.NextDue()
+			Expect(deploy).To(Equal("deploy-1"))
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("pending"))
+			Expect(fields["lease:recoveries"]).To(Equal("1"))
+		})
+	})
+})
@@ -0,0 +1,75 @@
+package deployer
+
+import (
+	"log"
+	"time"
+)
+
+// pauseCheckInterval is how often a paused deployer looks whether it was
+// resumed, deploys held back by a paused etcdDir are due again after it
+const pauseCheckInterval = 10 * time.Second
+
+// Paused tells whether the queue was paused the last time Run looked,
+// along with the reason given for it
+func (deployer *Deployer) Paused() (bool, string) {
+	deployer.pauseMutex.Lock()
+	defer deployer.pauseMutex.Unlock()
+
+	return deployer.paused, deployer.pauseReason
+}
+
+// checkPaused looks whether the whole queue is paused and logs every change
+func (deployer *Deployer) checkPaused() (bool, error) {
+	paused, reason, err := deployer.queue.Paused("")
+	if err != nil {
+		return false, err
+	}
+
+	deployer.pauseMutex.Lock()
+	defer deployer.pauseMutex.Unlock()
+
+	if paused && (!deployer.paused || reason != deployer.pauseReason) {
+		log.Printf("deploys paused: %v", describeReason(reason))
+	}
+	if !paused && deployer.paused {
+		log.Println("deploys resumed")
+	}
+
+	deployer.paused = paused
+	deployer.pauseReason = reason
+	return paused, nil
+}
+
+// holdPausedGroups puts the claimed deploys of paused etcdDirs back on the
+// queue, due once the pause is checked again, and returns the other groups
+func (deployer *Deployer) holdPausedGroups(groups [][]*Claim) ([][]*Claim, error) {
+	var unpaused [][]*Claim
+
+	for index, group := range groups {
+		etcdDir := group[0].Metadata.EtcdDir
+		paused, reason, err := deployer.queue.Paused(etcdDir)
+		if err != nil {
+			return append(unpaused, groups[index:]...), err
+		}
+
+		if !paused {
+			unpaused = append(unpaused, group)
+			continue
+		}
+
+		log.Printf("deploys to %v paused, holding %v deploys: %v", etcdDir, len(group), describeReason(reason))
+		err = deployer.requeueDeploys(group, deployer.clock.Now().Add(pauseCheckInterval))
+		if err != nil {
+			return append(unpaused, groups[index:]...), err
+		}
+	}
+
+	return unpaused, nil
+}
+
+func describeReason(reason string) string {
+	if reason == "" {
+		return "no reason given"
+	}
+	return reason
+}
@@ -0,0 +1,219 @@
+package deployer
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultLeaseDuration is how long a claimed deploy may stay
+// in flight before another instance is allowed to recover it
+const DefaultLeaseDuration = 5 * time.Minute
+
+// DefaultMaxLeaseRecoveries is how many times an abandoned deploy
+// is requeued before it is marked failed
+const DefaultMaxLeaseRecoveries = 3
+
+// DefaultMaxAttempts is how many times a failing deploy
+// is tried before it is dead lettered
+const DefaultMaxAttempts = 5
+
+// DefaultRetryBackoff is how long to wait before the first retry
+// of a failed deploy, it doubles with every attempt
+const DefaultRetryBackoff = 10 * time.Second
+
+// DefaultMaxNormalDelay is how long a due normal deploy
+// may wait behind urgent ones before it goes first
+const DefaultMaxNormalDelay = 5 * time.Minute
+
+// DefaultDeployTTL is how long the hash of a finished deploy is kept
+const DefaultDeployTTL = 7 * 24 * time.Hour
+
+const maxRetryBackoff = 10 * time.Minute
+
+// Queue is where the deployer takes its deploys from. A claimed deploy
+// stays in flight under a lease until it is acked, failed or requeued
+type Queue interface {
+	// NextDue returns the earliest scheduled deploy and when it is due,
+	// or an empty deploy when nothing is scheduled
+	NextDue() (string, time.Time, error)
+
+	// Claim takes the first due deploy off the queue and puts it in flight,
+	// it returns nil when nothing is due. A cancelled deploy is returned
+	// with Cancelled set and is already recorded as skipped
+	Claim() (*Claim, error)
+
+	// IsCancelled tells whether a cancellation was recorded for the deploy
+	IsCancelled(deploy string) (bool, error)
+
+	// Metadata returns the request metadata of a deploy
+	Metadata(deploy string) (*RequestMetadata, error)
+
+	// Applied returns the outcome of the last time the deploy was applied,
+	// deploying, done, cancelled, retrying or failed. It is empty for a
+	// deploy that was never started
+	Applied(deploy string) (string, error)
+
+	// Renew extends the lease of an in flight deploy. It fails when the
+	// deploy is no longer in flight under this instance, its lease ran out
+	// and it may have been claimed again, then it must be left alone
+	Renew(deploy string) error
+
+	// Start renews the lease of an in flight deploy
+	// and records that it is being deployed
+	Start(deploy string) error
+
+	// RecordRestart records that every key of an in flight deploy was
+	// written, so a retry only has to report it. Claims carry it as Restarted
+	RecordRestart(deploy string) error
+
+	// Ack takes a deploy out of flight with one of the Status constants,
+	// along with extra fields given as name, value pairs
+	Ack(deploy, status string, fields ...string) error
+
+	// Fail records a failed attempt and schedules the deploy again with
+	// exponential backoff, or dead letters it once it ran out of attempts.
+	// It returns when the deploy is due again, which is now when dead lettered
+	Fail(deploy string, cause error) (time.Time, error)
+
+	// Requeue puts an in flight deploy back on the queue without counting an attempt
+	Requeue(deploy string, dueAt time.Time) error
+
+	// Paused tells whether deploys are paused, along with the reason given.
+	// An empty etcdDir asks about the whole queue, otherwise about that etcdDir
+	Paused(etcdDir string) (bool, string, error)
+
+	// RecordRelease adds a release to the history of an etcdDir
+	RecordRelease(etcdDir string, release *Release) error
+
+	// Releases returns the history of an etcdDir, newest first
+	Releases(etcdDir string) ([]*Release, error)
+
+	// Recover requeues the in flight deploys whose lease ran out, which happens
+	// when the governator that claimed them died mid-deploy. Deploys that keep
+	// getting abandoned are marked failed instead
+	Recover() error
+}
+
+// Claim is a deploy taken off the queue
+type Claim struct {
+	Deploy    string
+	Metadata  *RequestMetadata
+	Cancelled bool
+
+	// DueAt is when the deploy was first due, retries and holds
+	// reschedule it without moving DueAt
+	DueAt time.Time
+
+	// Restarted tells that an earlier attempt wrote every key,
+	// only reporting the deploy is left
+	Restarted bool
+}
+
+// QueueOptions are the optional settings of a queue,
+// zero values are replaced with the defaults
+type QueueOptions struct {
+	// InstanceID identifies this governator as the owner of the deploys it claims
+	InstanceID string
+
+	// LeaseDuration is how long a claimed deploy may stay in flight
+	LeaseDuration time.Duration
+
+	// MaxLeaseRecoveries is how many times an abandoned deploy is requeued
+	MaxLeaseRecoveries int
+
+	// MaxAttempts is how many times a failing deploy is tried
+	// before it is moved to the dead letter set
+	MaxAttempts int
+
+	// RetryBackoff is the delay before the first retry of a failed deploy
+	RetryBackoff time.Duration
+
+	// MaxNormalDelay is how long a due normal deploy may wait behind urgent
+	// ones, after that it is claimed before them so it cannot starve
+	MaxNormalDelay time.Duration
+
+	// DeployTTL is how long the hash of a finished deploy is kept before
+	// redis expires it. Dead lettered deploys keep their hash
+	DeployTTL time.Duration
+
+	// Clock tells the queue what time it is, defaults to the system clock
+	Clock Clock
+
+	// HashTag wraps the queue name of every key in a redis cluster hash tag,
+	// see ClusterHashTag. The producer has to use the same keys
+	HashTag bool
+}
+
+func (options *QueueOptions) getInstanceID() string {
+	if options.InstanceID != "" {
+		return options.InstanceID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "governator"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+func (options *QueueOptions) getLeaseDuration() time.Duration {
+	if options.LeaseDuration > 0 {
+		return options.LeaseDuration
+	}
+	return DefaultLeaseDuration
+}
+
+func (options *QueueOptions) getMaxLeaseRecoveries() int {
+	if options.MaxLeaseRecoveries > 0 {
+		return options.MaxLeaseRecoveries
+	}
+	return DefaultMaxLeaseRecoveries
+}
+
+func (options *QueueOptions) getMaxAttempts() int {
+	if options.MaxAttempts > 0 {
+		return options.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+func (options *QueueOptions) getRetryBackoff() time.Duration {
+	if options.RetryBackoff > 0 {
+		return options.RetryBackoff
+	}
+	return DefaultRetryBackoff
+}
+
+func (options *QueueOptions) getMaxNormalDelay() time.Duration {
+	if options.MaxNormalDelay > 0 {
+		return options.MaxNormalDelay
+	}
+	return DefaultMaxNormalDelay
+}
+
+func (options *QueueOptions) getDeployTTL() time.Duration {
+	if options.DeployTTL > 0 {
+		return options.DeployTTL
+	}
+	return DefaultDeployTTL
+}
+
+func (options *QueueOptions) getClock() Clock {
+	if options.Clock != nil {
+		return options.Clock
+	}
+	return SystemClock{}
+}
+
+// getRetryDelay doubles the backoff for every attempt after the first
+func getRetryDelay(retryBackoff time.Duration, attempts int) time.Duration {
+	delay := retryBackoff
+	for attempt := 1; attempt < attempts; attempt++ {
+		delay *= 2
+		if delay > maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	return delay
+}
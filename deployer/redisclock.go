@@ -0,0 +1,124 @@
+package deployer
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultClockRefreshInterval is how often a RedisClock asks redis for the time
+const DefaultClockRefreshInterval = time.Minute
+
+// DefaultClockSkewWarning is how far local and redis time may drift
+// apart before a RedisClock logs a warning
+const DefaultClockSkewWarning = 5 * time.Second
+
+// RedisClock takes the time from the redis TIME command, the same server
+// the producer's scores are compared against. Between TIME calls it moves
+// on with the local monotonic clock
+type RedisClock struct {
+	redisPool       *redis.Pool
+	refreshInterval time.Duration
+	skewWarning     time.Duration
+	redisTime       time.Time
+	syncedAt        time.Time
+	checkedAt       time.Time
+	skew            time.Duration
+	mutex           sync.Mutex
+}
+
+// RedisClockOptions are the optional settings of a RedisClock,
+// zero values are replaced with the defaults
+type RedisClockOptions struct {
+	// RefreshInterval is how often redis is asked for the time
+	RefreshInterval time.Duration
+
+	// SkewWarning is the drift between local and redis time that gets logged
+	SkewWarning time.Duration
+}
+
+// NewRedisClock constructs a clock on top of redis, options may be nil
+func NewRedisClock(redisPool *redis.Pool, options *RedisClockOptions) *RedisClock {
+	if options == nil {
+		options = &RedisClockOptions{}
+	}
+
+	return &RedisClock{
+		redisPool:       redisPool,
+		refreshInterval: options.getRefreshInterval(),
+		skewWarning:     options.getSkewWarning(),
+	}
+}
+
+// Now returns the redis time. Until redis answered once it returns the
+// local time, after that a failing TIME call keeps the last offset
+func (clock *RedisClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if clock.checkedAt.IsZero() || time.Since(clock.checkedAt) >= clock.refreshInterval {
+		clock.checkedAt = time.Now()
+		err := clock.sync()
+		if err != nil {
+			log.Println("Redis TIME error", err)
+		}
+	}
+
+	if clock.syncedAt.IsZero() {
+		return time.Now()
+	}
+	return clock.redisTime.Add(time.Since(clock.syncedAt))
+}
+
+// Skew returns how far redis time was ahead of local time on the last TIME call
+func (clock *RedisClock) Skew() time.Duration {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.skew
+}
+
+func (clock *RedisClock) sync() error {
+	redisConn := clock.redisPool.Get()
+	defer redisConn.Close()
+
+	before := time.Now()
+	reply, err := redis.Values(redisConn.Do("TIME"))
+	if err != nil {
+		return err
+	}
+
+	var seconds, microseconds int64
+	_, err = redis.Scan(reply, &seconds, &microseconds)
+	if err != nil {
+		return fmt.Errorf("unexpected TIME reply: %v", err)
+	}
+
+	// redis read its clock about halfway through the round trip
+	clock.syncedAt = before.Add(time.Since(before) / 2)
+	clock.redisTime = time.Unix(seconds, microseconds*int64(time.Microsecond))
+	clock.skew = clock.redisTime.Sub(clock.syncedAt)
+	debug("redis time is %v ahead of local time", clock.skew)
+
+	if clock.skew > clock.skewWarning || clock.skew < -clock.skewWarning {
+		log.Printf("redis time is %v ahead of local time, more than the %v warning threshold", clock.skew, clock.skewWarning)
+	}
+	return nil
+}
+
+func (options *RedisClockOptions) getRefreshInterval() time.Duration {
+	if options.RefreshInterval > 0 {
+		return options.RefreshInterval
+	}
+	return DefaultClockRefreshInterval
+}
+
+func (options *RedisClockOptions) getSkewWarning() time.Duration {
+	if options.SkewWarning > 0 {
+		return options.SkewWarning
+	}
+	return DefaultClockSkewWarning
+}
@@ -0,0 +1,63 @@
+package deployer_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RedisClock", func() {
+	var sut *deployer.RedisClock
+	var redisConn *redigomock.Conn
+	var redisTime time.Time
+
+	BeforeEach(func() {
+		redisConn = redigomock.NewConn()
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
+		sut = deployer.NewRedisClock(redisPool, nil)
+		redisTime = time.Now().Add(time.Hour).Truncate(time.Microsecond)
+	})
+
+	Describe("When redis is an hour ahead", func() {
+		var timeCmd *redigomock.Cmd
+		var now time.Time
+
+		BeforeEach(func() {
+			timeCmd = redisConn.Command("TIME").Expect([]interface{}{
+				[]byte(fmt.Sprintf("%d", redisTime.Unix())),
+				[]byte(fmt.Sprintf("%d", redisTime.Nanosecond()/1000)),
+			})
+			now = sut.Now()
+		})
+
+		It("Should return the redis time", func() {
+			Expect(now).To(BeTemporally("~", redisTime, time.Second))
+		})
+
+		It("Should report the skew", func() {
+			Expect(sut.Skew()).To(BeNumerically("~", time.Hour, time.Second))
+		})
+
+		It("Should move on with the local clock until the next refresh", func() {
+			later := sut.Now()
+			Expect(later).To(BeTemporally(">=", now))
+			Expect(redisConn.Stats(timeCmd)).To(Equal(1), "TIME was called again")
+		})
+	})
+
+	Describe("When redis cannot tell the time", func() {
+		BeforeEach(func() {
+			redisConn.Command("TIME").ExpectError(fmt.Errorf("redis is gone"))
+		})
+
+		It("Should fall back to the local time", func() {
+			Expect(sut.Now()).To(BeTemporally("~", time.Now(), time.Second))
+		})
+	})
+})
@@ -0,0 +1,55 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Pause pauses deploys for the whole queue with an empty etcdDir, otherwise
+// for that etcdDir. The pause is the <queue>:governator:paused key, or
+// <queue>:governator:paused:<etcdDir>, holding the reason. Redis expires
+// it after ttl unless ttl is zero
+func (queue *RedisQueue) Pause(etcdDir, reason string, ttl time.Duration) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	args := []interface{}{queue.getPauseKey(etcdDir), reason}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+
+	_, err := redisConn.Do("SET", args...)
+	return err
+}
+
+// Resume ends a pause and tells whether there was one
+func (queue *RedisQueue) Resume(etcdDir string) (bool, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	return redis.Bool(redisConn.Do("DEL", queue.getPauseKey(etcdDir)))
+}
+
+// Paused tells whether deploys are paused, along with the reason given
+func (queue *RedisQueue) Paused(etcdDir string) (bool, string, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	reason, err := redis.String(redisConn.Do("GET", queue.getPauseKey(etcdDir)))
+	if err == redis.ErrNil {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	return true, reason, nil
+}
+
+func (queue *RedisQueue) getPauseKey(etcdDir string) string {
+	if etcdDir == "" {
+		return queue.getKey("governator:paused")
+	}
+	return queue.getKey(fmt.Sprintf("governator:paused:%s", etcdDir))
+}
@@ -0,0 +1,355 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisQueue is the Queue governator-service produces into. Deploys are
+// scheduled in the <queue>:governator:deploys zset and described by the
+// <queue>:<deploy> hash, claimed deploys wait in <queue>:governator:inflight.
+// Hotfixes scheduled in <queue>:governator:deploys:urgent are claimed first
+type RedisQueue struct {
+	redisPool          *redis.Pool
+	keyPrefix          string
+	instanceID         string
+	leaseDuration      time.Duration
+	maxLeaseRecoveries int
+	maxAttempts        int
+	retryBackoff       time.Duration
+	maxNormalDelay     time.Duration
+	deployTTL          time.Duration
+	clock              Clock
+}
+
+// NewRedisQueue constructs a queue on top of redis, options may be nil
+func NewRedisQueue(redisPool *redis.Pool, queueName string, options *QueueOptions) *RedisQueue {
+	if options == nil {
+		options = &QueueOptions{}
+	}
+
+	return &RedisQueue{
+		redisPool:          redisPool,
+		keyPrefix:          getKeyPrefix(queueName, options.HashTag),
+		instanceID:         options.getInstanceID(),
+		leaseDuration:      options.getLeaseDuration(),
+		maxLeaseRecoveries: options.getMaxLeaseRecoveries(),
+		maxAttempts:        options.getMaxAttempts(),
+		retryBackoff:       options.getRetryBackoff(),
+		maxNormalDelay:     options.getMaxNormalDelay(),
+		deployTTL:          options.getDeployTTL(),
+		clock:              options.getClock(),
+	}
+}
+
+// NextDue returns the earliest scheduled deploy of either lane and when it is due
+func (queue *RedisQueue) NextDue() (string, time.Time, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	deploy, dueAt, err := queue.firstScheduled(redisConn, "governator:deploys")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	urgentDeploy, urgentDueAt, err := queue.firstScheduled(redisConn, "governator:deploys:urgent")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if urgentDeploy != "" && (deploy == "" || urgentDueAt.Before(dueAt)) {
+		return urgentDeploy, urgentDueAt, nil
+	}
+	return deploy, dueAt, nil
+}
+
+func (queue *RedisQueue) firstScheduled(redisConn redis.Conn, key string) (string, time.Time, error) {
+	reply, err := redis.Strings(redisConn.Do("ZRANGEBYSCORE", queue.getKey(key), "-inf", "+inf", "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if len(reply) < 2 {
+		return "", time.Time{}, nil
+	}
+
+	score, err := strconv.ParseFloat(reply[1], 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return reply[0], time.Unix(int64(score), 0), nil
+}
+
+// IsCancelled tells whether the deploy's hash has a cancellation
+func (queue *RedisQueue) IsCancelled(deploy string) (bool, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	return redis.Bool(redisConn.Do("HEXISTS", queue.getKey(deploy), "cancellation"))
+}
+
+// Metadata returns the request:metadata of the deploy's hash
+func (queue *RedisQueue) Metadata(deploy string) (*RequestMetadata, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	metadataBytes, err := redis.Bytes(redisConn.Do("HGET", queue.getKey(deploy), "request:metadata"))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("Deploy metadata not found for '%v'", deploy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata RequestMetadata
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+// Start renews the lease of an in flight deploy
+// and records that it is being deployed
+func (queue *RedisQueue) Start(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	err := queue.renew(redisConn, deploy)
+	if err != nil {
+		return err
+	}
+
+	err = queue.recordApplied(redisConn, deploy, StatusDeploying)
+	if err != nil {
+		return err
+	}
+
+	return queue.setStatus(redisConn, deploy, StatusDeploying)
+}
+
+// RecordRestart records that every key of the deploy was written
+func (queue *RedisQueue) RecordRestart(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	_, err := redisConn.Do("HSET", queue.getKey(deploy), "restarted:at", queue.clock.Now().Unix())
+	return err
+}
+
+// Applied returns the outcome of the last time the deploy was applied,
+// it is kept apart from the deploy hash so claiming does not overwrite it
+func (queue *RedisQueue) Applied(deploy string) (string, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	outcome, err := redis.String(redisConn.Do("GET", queue.getAppliedKey(deploy)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return outcome, err
+}
+
+// Ack records how an in flight deploy finished and takes it out of flight
+func (queue *RedisQueue) Ack(deploy, status string, fields ...string) error {
+	debug("ack: %v %v", deploy, status)
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	statusFields := []interface{}{"finished:at", queue.clock.Now().Unix()}
+	for _, field := range fields {
+		statusFields = append(statusFields, field)
+	}
+
+	err := queue.setStatus(redisConn, deploy, status, statusFields...)
+	if err != nil {
+		return err
+	}
+
+	if status == StatusDone || status == StatusCancelled {
+		err = queue.recordApplied(redisConn, deploy, status)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = redisConn.Do("ZREM", queue.getKey("governator:inflight"), deploy)
+	if err != nil {
+		return err
+	}
+
+	return queue.expire(redisConn, deploy)
+}
+
+// Requeue puts an in flight deploy back on the queue without counting an attempt
+func (queue *RedisQueue) Requeue(deploy string, dueAt time.Time) error {
+	debug("requeue: %v", deploy)
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	deploysKey, err := queue.getDeploysKey(redisConn, deploy)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("ZADD", deploysKey, dueAt.Unix(), deploy)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("ZREM", queue.getKey("governator:inflight"), deploy)
+	if err != nil {
+		return err
+	}
+
+	return queue.setStatus(redisConn, deploy, StatusPending)
+}
+
+// Recover requeues the in flight deploys whose lease ran out
+func (queue *RedisQueue) Recover() error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	now := queue.clock.Now().Unix()
+	deploys, err := redis.Strings(redisConn.Do("ZRANGEBYSCORE", queue.getKey("governator:inflight"), 0, now))
+	if err != nil {
+		return err
+	}
+
+	for _, deploy := range deploys {
+		err = queue.recoverDeploy(redisConn, deploy, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverScript requeues a deploy whose lease ran out in one atomic step,
+// so a crash cannot drop it halfway and a lease renewed since it was found
+// is left alone. A deploy abandoned too many times is marked failed instead.
+// It returns held, missing, failed or requeued
+//
+// KEYS[1] in flight zset, KEYS[2] deploys zset, KEYS[3] urgent deploys zset
+// ARGV[1] now, ARGV[2] deploy, ARGV[3] deploy key prefix,
+// ARGV[4] max lease recoveries, ARGV[5] deploy TTL in seconds
+var recoverScript = redis.NewScript(3, `
+local deadline = redis.call('ZSCORE', KEYS[1], ARGV[2])
+if not deadline or tonumber(deadline) > tonumber(ARGV[1]) then
+  return 'held'
+end
+
+redis.call('ZREM', KEYS[1], ARGV[2])
+local deployKey = ARGV[3] .. ARGV[2]
+if redis.call('HEXISTS', deployKey, 'request:metadata') == 0 then
+  return 'missing'
+end
+
+local recoveries = redis.call('HINCRBY', deployKey, 'lease:recoveries', 1)
+if recoveries > tonumber(ARGV[4]) then
+  redis.call('HMSET', deployKey, 'status', 'failed', 'finished:at', ARGV[1], 'error', 'lease expired ' .. recoveries .. ' times')
+  redis.call('EXPIRE', deployKey, ARGV[5])
+  return 'failed'
+end
+
+local lane = KEYS[2]
+if redis.call('HGET', deployKey, 'lane') == 'urgent' then
+  lane = KEYS[3]
+end
+redis.call('ZADD', lane, ARGV[1], ARGV[2])
+redis.call('HMSET', deployKey, 'status', 'pending')
+return 'requeued'
+`)
+
+func (queue *RedisQueue) recoverDeploy(redisConn redis.Conn, deploy string, now int64) error {
+	debug("recoverDeploy: %v", deploy)
+	outcome, err := redis.String(recoverScript.Do(
+		redisConn,
+		queue.getKey("governator:inflight"),
+		queue.getKey("governator:deploys"),
+		queue.getKey("governator:deploys:urgent"),
+		now,
+		deploy,
+		queue.getKey(""),
+		queue.maxLeaseRecoveries,
+		int64(queue.deployTTL/time.Second),
+	))
+	if err != nil {
+		return err
+	}
+
+	switch outcome {
+	case "held":
+		debug("Another instance recovered or renewed: %v", deploy)
+	case "missing":
+		debug("Dropping abandoned deploy without metadata: %v", deploy)
+	case "failed":
+		debug("Deploy abandoned too many times, marking failed: %v", deploy)
+	default:
+		debug("Requeued abandoned deploy: %v", deploy)
+	}
+	return nil
+}
+
+// setStatus records the status of a deploy along with any extra fields
+func (queue *RedisQueue) setStatus(redisConn redis.Conn, deploy, status string, fields ...interface{}) error {
+	args := []interface{}{queue.getKey(deploy), "status", status}
+	args = append(args, fields...)
+
+	_, err := redisConn.Do("HMSET", args...)
+	return err
+}
+
+// expire lets redis remove the hash of a finished deploy after the deploy TTL
+func (queue *RedisQueue) expire(redisConn redis.Conn, deploy string) error {
+	_, err := redisConn.Do("EXPIRE", queue.getKey(deploy), int64(queue.deployTTL/time.Second))
+	return err
+}
+
+// recordApplied records the outcome of applying the deploy for as long
+// as the hash of a finished deploy is kept
+func (queue *RedisQueue) recordApplied(redisConn redis.Conn, deploy, outcome string) error {
+	_, err := redisConn.Do("SET", queue.getAppliedKey(deploy), outcome, "EX", int64(queue.deployTTL/time.Second))
+	return err
+}
+
+func (queue *RedisQueue) getAppliedKey(deploy string) string {
+	return queue.getKey(fmt.Sprintf("governator:applied:%s", deploy))
+}
+
+// ClusterHashTag is the hash tag that puts every key of a queue in the same
+// redis cluster slot, so the claim script can touch them together
+func ClusterHashTag(queueName string) string {
+	return fmt.Sprintf("{%s}", queueName)
+}
+
+// getDeploysKey returns the zset of the lane the deploy was claimed from
+func (queue *RedisQueue) getDeploysKey(redisConn redis.Conn, deploy string) (string, error) {
+	lane, err := redis.String(redisConn.Do("HGET", queue.getKey(deploy), "lane"))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+
+	if lane == "urgent" {
+		return queue.getKey("governator:deploys:urgent"), nil
+	}
+	return queue.getKey("governator:deploys"), nil
+}
+
+func getKeyPrefix(queueName string, hashTag bool) string {
+	if hashTag {
+		return ClusterHashTag(queueName)
+	}
+	return queueName
+}
+
+func (queue *RedisQueue) getKey(key string) string {
+	return fmt.Sprintf("%s:%s", queue.keyPrefix, key)
+}
@@ -0,0 +1,76 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// EnqueueUrgent schedules a deploy in the urgent lane
+// the way governator-service does
+func (queue *RedisQueue) EnqueueUrgent(deploy string, dueAt time.Time, metadata *RequestMetadata) error {
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	_, err = redisConn.Do("HSET", queue.getKey(deploy), "request:metadata", metadataBytes)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("ZADD", queue.getKey("governator:deploys:urgent"), dueAt.Unix(), deploy)
+	return err
+}
+
+// RecordRelease adds a release to the <queue>:governator:releases:<etcdDir>
+// list, which keeps the newest releases first
+func (queue *RedisQueue) RecordRelease(etcdDir string, release *Release) error {
+	releaseBytes, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	key := queue.getReleasesKey(etcdDir)
+	_, err = redisConn.Do("LPUSH", key, releaseBytes)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("LTRIM", key, 0, maxReleases-1)
+	return err
+}
+
+// Releases returns the releases of an etcdDir, newest first
+func (queue *RedisQueue) Releases(etcdDir string) ([]*Release, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	values, err := redis.ByteSlices(redisConn.Do("LRANGE", queue.getReleasesKey(etcdDir), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]*Release, 0, len(values))
+	for _, value := range values {
+		var release Release
+		err = json.Unmarshal(value, &release)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, &release)
+	}
+	return releases, nil
+}
+
+func (queue *RedisQueue) getReleasesKey(etcdDir string) string {
+	return queue.getKey(fmt.Sprintf("governator:releases:%s", etcdDir))
+}
@@ -0,0 +1,158 @@
+package deployer
+
+import (
+	"fmt"
+	"log"
+)
+
+// RequestTypeRollback is the type of a request that rolls an etcdDir back
+// to an earlier release instead of deploying a docker url
+const RequestTypeRollback = "rollback"
+
+// maxReleases is how many releases are kept per etcdDir
+const maxReleases = 20
+
+// Release is a docker url that was deployed to an etcdDir
+// along with what the etcdDir ran before
+type Release struct {
+	Deploy            string `json:"deploy"`
+	DockerURL         string `json:"dockerUrl"`
+	Release           string `json:"release"`
+	DeployedAt        int64  `json:"deployedAt"`
+	PreviousDockerURL string `json:"previousDockerUrl,omitempty"`
+	PreviousRelease   string `json:"previousRelease,omitempty"`
+	Rollback          bool   `json:"rollback,omitempty"`
+
+	// DueAt is the unix time the deploy was due at
+	DueAt int64 `json:"dueAt,omitempty"`
+}
+
+// FindRollbackTarget returns the docker url to roll back to from releases,
+// newest first. Without to that is what the newest release replaced that
+// was not rolled back already, every rollback undoes one release before
+// it. Otherwise it is the release, deploy or docker url named by to
+func FindRollbackTarget(releases []*Release, to string) (string, error) {
+	if len(releases) == 0 {
+		return "", fmt.Errorf("No releases recorded")
+	}
+
+	if to == "" {
+		rolledBack := 0
+		for _, release := range releases {
+			if release.Rollback {
+				rolledBack++
+				continue
+			}
+
+			if rolledBack > 0 {
+				rolledBack--
+				continue
+			}
+
+			if release.PreviousDockerURL == "" {
+				return "", fmt.Errorf("No release before %v", release.DockerURL)
+			}
+			return release.PreviousDockerURL, nil
+		}
+		return "", fmt.Errorf("No release before %v", releases[0].DockerURL)
+	}
+
+	for _, release := range releases {
+		if release.Release == to || release.Deploy == to || release.DockerURL == to {
+			return release.DockerURL, nil
+		}
+	}
+
+	for _, release := range releases {
+		if release.PreviousRelease == to || release.PreviousDockerURL == to {
+			return release.PreviousDockerURL, nil
+		}
+	}
+	return "", fmt.Errorf("No release '%v' recorded", to)
+}
+
+// resolveRollback turns a rollback request into a deploy of
+// the docker url it rolls back to
+func (deployer *Deployer) resolveRollback(claim *Claim) error {
+	metadata := claim.Metadata
+	if metadata.Type != RequestTypeRollback {
+		return nil
+	}
+
+	releases, err := deployer.queue.Releases(metadata.EtcdDir)
+	if err != nil {
+		return err
+	}
+
+	dockerURL, err := FindRollbackTarget(releases, metadata.RollbackTo)
+	if err != nil {
+		return fmt.Errorf("Cannot roll %v back: %v", metadata.EtcdDir, err)
+	}
+
+	log.Printf("rolling %v back to %v", metadata.EtcdDir, dockerURL)
+	metadata.DockerURL = dockerURL
+	return nil
+}
+
+// newerRelease returns the newest release of the etcdDir of a deploy when
+// it was due after the deploy. Urgent deploys overtake normal ones, once
+// one went out an older deploy would only put an older docker url back
+func (deployer *Deployer) newerRelease(claim *Claim) (*Release, error) {
+	if claim.DueAt.IsZero() {
+		return nil, nil
+	}
+
+	releases, err := deployer.queue.Releases(claim.Metadata.EtcdDir)
+	if err != nil || len(releases) == 0 {
+		return nil, err
+	}
+
+	if releases[0].DueAt > claim.DueAt.Unix() {
+		return releases[0], nil
+	}
+	return nil, nil
+}
+
+// recordRelease adds a deploy that went out to the history of its etcdDir,
+// along with the docker url it replaced. That is the newest release
+// recorded, the snapshot of the deploy is only used for the first one,
+// since a retried deploy finds what its earlier attempt wrote. The deploy
+// went out either way, so failing to record it is only logged
+func (deployer *Deployer) recordRelease(claim *Claim, snapshot EtcdValue) {
+	etcdDir := claim.Metadata.EtcdDir
+	release := &Release{
+		Deploy:     claim.Deploy,
+		DockerURL:  claim.Metadata.DockerURL,
+		Release:    deployer.getReleaseVersion(claim.Metadata.DockerURL),
+		DeployedAt: deployer.clock.Now().Unix(),
+		Rollback:   claim.Metadata.Type == RequestTypeRollback,
+	}
+	if !claim.DueAt.IsZero() {
+		release.DueAt = claim.DueAt.Unix()
+	}
+
+	releases, err := deployer.queue.Releases(etcdDir)
+	if err != nil {
+		log.Printf("could not record release %v of %v: %v", release.Release, etcdDir, err)
+		return
+	}
+
+	previousDockerURL := snapshot.Value
+	if len(releases) > 0 {
+		previousDockerURL = releases[0].DockerURL
+		if previousDockerURL == release.DockerURL {
+			previousDockerURL = releases[0].PreviousDockerURL
+		}
+	}
+
+	// without a history a retry cannot tell what ran before its first attempt
+	if previousDockerURL != "" && previousDockerURL != release.DockerURL {
+		release.PreviousDockerURL = previousDockerURL
+		release.PreviousRelease = deployer.getReleaseVersion(previousDockerURL)
+	}
+
+	err = deployer.queue.RecordRelease(etcdDir, release)
+	if err != nil {
+		log.Printf("could not record release %v of %v: %v", release.Release, etcdDir, err)
+	}
+}
@@ -0,0 +1,52 @@
+package deployer_test
+
+import (
+	"github.com/octoblu/governator/deployer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FindRollbackTarget", func() {
+	var releases []*deployer.Release
+
+	BeforeEach(func() {
+		releases = []*deployer.Release{
+			{Deploy: "deploy-3", DockerURL: "octoblu/service-a:v3", Release: "v3", PreviousDockerURL: "octoblu/service-a:v2", PreviousRelease: "v2"},
+			{Deploy: "deploy-2", DockerURL: "octoblu/service-a:v2", Release: "v2", PreviousDockerURL: "octoblu/service-a:v1", PreviousRelease: "v1"},
+		}
+	})
+
+	It("Should go back to what the newest release replaced", func() {
+		Expect(deployer.FindRollbackTarget(releases, "")).To(Equal("octoblu/service-a:v2"))
+	})
+
+	It("Should go back further on every rollback", func() {
+		releases = append([]*deployer.Release{
+			{Deploy: "rollback-1", DockerURL: "octoblu/service-a:v2", Release: "v2", PreviousDockerURL: "octoblu/service-a:v3", Rollback: true},
+		}, releases...)
+		Expect(deployer.FindRollbackTarget(releases, "")).To(Equal("octoblu/service-a:v1"))
+	})
+
+	It("Should fail once every release was rolled back", func() {
+		releases = append([]*deployer.Release{
+			{Deploy: "rollback-2", DockerURL: "octoblu/service-a:v1", Rollback: true},
+			{Deploy: "rollback-1", DockerURL: "octoblu/service-a:v2", Rollback: true},
+		}, releases...)
+		_, err := deployer.FindRollbackTarget(releases, "")
+		Expect(err).To(MatchError("No release before octoblu/service-a:v1"))
+	})
+
+	It("Should go back to a named release", func() {
+		Expect(deployer.FindRollbackTarget(releases, "deploy-2")).To(Equal("octoblu/service-a:v2"))
+	})
+
+	It("Should go back to a release only known as a previous one", func() {
+		Expect(deployer.FindRollbackTarget(releases, "v1")).To(Equal("octoblu/service-a:v1"))
+	})
+
+	It("Should fail for an unknown release", func() {
+		_, err := deployer.FindRollbackTarget(releases, "v0")
+		Expect(err).To(MatchError("No release 'v0' recorded"))
+	})
+})
@@ -0,0 +1,119 @@
+package deployer
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DeadLetters lists the deploys that ran out of attempts, oldest first
+func (queue *RedisQueue) DeadLetters() ([]string, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	return redis.Strings(redisConn.Do("ZRANGE", queue.getKey("governator:deadletter"), 0, -1))
+}
+
+// InspectDeploy returns every field of a deploy's hash
+func (queue *RedisQueue) InspectDeploy(deploy string) (map[string]string, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	fields, err := redis.StringMap(redisConn.Do("HGETALL", queue.getKey(deploy)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Deploy not found: '%v'", deploy)
+	}
+
+	return fields, nil
+}
+
+// RequeueDeadLetter moves a dead lettered deploy back onto the queue,
+// due right away and with its attempts reset
+func (queue *RedisQueue) RequeueDeadLetter(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	removed, err := redis.Int(redisConn.Do("ZREM", queue.getKey("governator:deadletter"), deploy))
+	if err != nil {
+		return err
+	}
+
+	if removed == 0 {
+		return fmt.Errorf("Deploy is not dead lettered: '%v'", deploy)
+	}
+
+	_, err = redisConn.Do("HDEL", queue.getKey(deploy), "attempts", "error", "finished:at")
+	if err != nil {
+		return err
+	}
+
+	deploysKey, err := queue.getDeploysKey(redisConn, deploy)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("ZADD", deploysKey, queue.clock.Now().Unix(), deploy)
+	if err != nil {
+		return err
+	}
+
+	return queue.setStatus(redisConn, deploy, StatusPending)
+}
+
+// Fail records a failed attempt and schedules the deploy again with
+// exponential backoff, or dead letters it once it ran out of attempts.
+// It returns when the deploy is due again, which is now when dead lettered
+func (queue *RedisQueue) Fail(deploy string, cause error) (time.Time, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	now := queue.clock.Now()
+	attempts, err := redis.Int(redisConn.Do("HINCRBY", queue.getKey(deploy), "attempts", 1))
+	if err != nil {
+		return now, err
+	}
+
+	retryAt := now
+	if attempts >= queue.maxAttempts {
+		log.Printf("deploy %v failed %v times, dead lettering it: %v", deploy, attempts, cause)
+		err = queue.setStatus(redisConn, deploy, StatusFailed, "finished:at", now.Unix(), "error", cause.Error())
+		if err != nil {
+			return now, err
+		}
+		err = queue.recordApplied(redisConn, deploy, StatusFailed)
+		if err != nil {
+			return now, err
+		}
+		_, err = redisConn.Do("ZADD", queue.getKey("governator:deadletter"), now.Unix(), deploy)
+	} else {
+		var deploysKey string
+		deploysKey, err = queue.getDeploysKey(redisConn, deploy)
+		if err != nil {
+			return now, err
+		}
+
+		retryAt = now.Add(getRetryDelay(queue.retryBackoff, attempts))
+		log.Printf("deploy %v failed (attempt %v of %v), retrying at %v: %v", deploy, attempts, queue.maxAttempts, retryAt, cause)
+		err = queue.setStatus(redisConn, deploy, StatusRetrying, "error", cause.Error())
+		if err != nil {
+			return now, err
+		}
+		err = queue.recordApplied(redisConn, deploy, StatusRetrying)
+		if err != nil {
+			return now, err
+		}
+		_, err = redisConn.Do("ZADD", deploysKey, retryAt.Unix(), deploy)
+	}
+	if err != nil {
+		return now, err
+	}
+
+	_, err = redisConn.Do("ZREM", queue.getKey("governator:inflight"), deploy)
+	return retryAt, err
+}
@@ -0,0 +1,145 @@
+package deployer_test
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retry", func() {
+	var sut *deployer.Deployer
+	var queue *deployer.RedisQueue
+	var redisConn *redigomock.Conn
+	var etcdClient *FakeEtcdClient
+	var err error
+
+	BeforeEach(func() {
+		redisConn = redigomock.NewConn()
+		redisConn.GenericCommand("EXPIRE")
+		redisConn.GenericCommand("GET")
+		redisConn.GenericCommand("SET")
+		noReleases(redisConn)
+		redisConn.GenericCommand("HSET")
+		redisConn.GenericCommand("HGET")
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
+		etcdClient = &FakeEtcdClient{}
+		queue = deployer.NewRedisQueue(redisPool, "redis-queue:name", &deployer.QueueOptions{
+			InstanceID:  "governator-1",
+			MaxAttempts: 3,
+		})
+		sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", nil)
+	})
+
+	Describe("When a deploy fails for the last time", func() {
+		var zaddDeadLetter, zaddRetry, zremInflight, statusFailed *redigomock.Cmd
+
+		BeforeEach(func() {
+			redisConn.GenericCommand("EVALSHA").Expect(claimedReply("deploy-1", "/octoblu/service-a", "octoblu/service-a:v1"))
+			redisConn.Command("HINCRBY", "redis-queue:name:deploy-1", "attempts", 1).Expect(int64(3))
+			redisConn.GenericCommand("HMSET")
+			statusFailed = redisConn.Command("HMSET", "redis-queue:name:deploy-1", "status", "failed", "finished:at", redigomock.NewAnyInt(), "error", "etcd is gone").Expect("OK")
+			zaddDeadLetter = redisConn.Command("ZADD", "redis-queue:name:governator:deadletter", redigomock.NewAnyInt(), "deploy-1").Expect(int64(1))
+			redisConn.GenericCommand("HEXISTS").Expect(int64(0))
+			renewedLease(redisConn, "deploy-1")
+			zaddRetry = redisConn.Command("ZADD", "redis-queue:name:governator:deploys", redigomock.NewAnyInt(), "deploy-1").Expect(int64(1))
+			zremInflight = redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "deploy-1").Expect(int64(1))
+			etcdClient.SetError = fmt.Errorf("etcd is gone")
+			err = sut.Run()
+		})
+
+		It("Should move the deploy to the dead letter set", func() {
+			Expect(err).To(BeNil())
+			Expect(redisConn.Stats(zaddDeadLetter)).To(Equal(1), "ZADD was not called enough times")
+			Expect(redisConn.Stats(zaddRetry)).To(Equal(0))
+			Expect(redisConn.Stats(zremInflight)).To(Equal(1), "ZREM was not called enough times")
+		})
+
+		It("Should record the deploy as failed", func() {
+			Expect(redisConn.Stats(statusFailed)).To(Equal(1), "HMSET was not called enough times")
+		})
+	})
+
+	Describe("DeadLetters", func() {
+		var deploys []string
+
+		BeforeEach(func() {
+			redisConn.Command("ZRANGE", "redis-queue:name:governator:deadletter", 0, -1).Expect([]interface{}{[]byte("deploy-1"), []byte("deploy-2")})
+			deploys, err = queue.DeadLetters()
+		})
+
+		It("Should list the dead lettered deploys", func() {
+			Expect(err).To(BeNil())
+			Expect(deploys).To(Equal([]string{"deploy-1", "deploy-2"}))
+		})
+	})
+
+	Describe("InspectDeploy", func() {
+		var fields map[string]string
+
+		Describe("When the deploy exists", func() {
+			BeforeEach(func() {
+				redisConn.Command("HGETALL", "redis-queue:name:deploy-1").Expect([]interface{}{
+					[]byte("attempts"), []byte("3"),
+					[]byte("error"), []byte("etcd is gone"),
+				})
+				fields, err = queue.InspectDeploy("deploy-1")
+			})
+
+			It("Should return the fields", func() {
+				Expect(err).To(BeNil())
+				Expect(fields).To(Equal(map[string]string{"attempts": "3", "error": "etcd is gone"}))
+			})
+		})
+
+		Describe("When the deploy does not exist", func() {
+			BeforeEach(func() {
+				redisConn.Command("HGETALL", "redis-queue:name:deploy-1").Expect([]interface{}{})
+				fields, err = queue.InspectDeploy("deploy-1")
+			})
+
+			It("Should return an error", func() {
+				Expect(err).To(MatchError("Deploy not found: 'deploy-1'"))
+			})
+		})
+	})
+
+	Describe("RequeueDeadLetter", func() {
+		var hdel, zadd *redigomock.Cmd
+
+		BeforeEach(func() {
+			hdel = redisConn.Command("HDEL", "redis-queue:name:deploy-1", "attempts", "error", "finished:at").Expect(int64(2))
+			redisConn.Command("HMSET", "redis-queue:name:deploy-1", "status", "pending").Expect("OK")
+			zadd = redisConn.Command("ZADD", "redis-queue:name:governator:deploys", redigomock.NewAnyInt(), "deploy-1").Expect(int64(1))
+		})
+
+		Describe("When the deploy is dead lettered", func() {
+			BeforeEach(func() {
+				redisConn.Command("ZREM", "redis-queue:name:governator:deadletter", "deploy-1").Expect(int64(1))
+				err = queue.RequeueDeadLetter("deploy-1")
+			})
+
+			It("Should reset the attempts and requeue it", func() {
+				Expect(err).To(BeNil())
+				Expect(redisConn.Stats(hdel)).To(Equal(1), "HDEL was not called enough times")
+				Expect(redisConn.Stats(zadd)).To(Equal(1), "ZADD was not called enough times")
+			})
+		})
+
+		Describe("When the deploy is not dead lettered", func() {
+			BeforeEach(func() {
+				redisConn.Command("ZREM", "redis-queue:name:governator:deadletter", "deploy-1").Expect(int64(0))
+				err = queue.RequeueDeadLetter("deploy-1")
+			})
+
+			It("Should return an error without requeueing", func() {
+				Expect(err).To(MatchError("Deploy is not dead lettered: 'deploy-1'"))
+				Expect(redisConn.Stats(zadd)).To(Equal(0))
+			})
+		})
+	})
+})
@@ -0,0 +1,263 @@
+package deployer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScheduleSearch is how far ahead Next looks for an allowed moment
+const maxScheduleSearch = 366 * 24 * time.Hour
+
+// Schedule tells when deploys may go out. A moment is allowed when it
+// matches one of the allowed windows, or any moment when there are none,
+// and it is outside every blackout. Times are read in the schedule's zone
+type Schedule struct {
+	location  *time.Location
+	windows   []*cronWindow
+	blackouts []blackout
+}
+
+// Blackout is a range of time without deploys, From and To are read as
+// RFC 3339 or as 2006-01-02 15:04 in the time zone of the schedule
+type Blackout struct {
+	From   string
+	To     string
+	Reason string
+}
+
+type blackout struct {
+	from   time.Time
+	to     time.Time
+	reason string
+}
+
+// cronWindow is a five field cron expression, minute hour day-of-month
+// month day-of-week, a moment is in the window when every field matches
+type cronWindow struct {
+	minutes       map[int]bool
+	hours         map[int]bool
+	daysOfMonth   map[int]bool
+	months        map[int]bool
+	daysOfWeek    map[int]bool
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// NewSchedule parses a schedule. The time zone defaults to UTC, allowed
+// holds cron expressions like "* 9-16 * * mon-thu"
+func NewSchedule(timeZone string, allowed []string, blackouts []Blackout) (*Schedule, error) {
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &Schedule{location: location}
+	for _, expression := range allowed {
+		window, err := parseCronWindow(expression)
+		if err != nil {
+			return nil, err
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+
+	for _, config := range blackouts {
+		from, err := parseScheduleTime(config.From, location)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseScheduleTime(config.To, location)
+		if err != nil {
+			return nil, err
+		}
+
+		if !to.After(from) {
+			return nil, fmt.Errorf("Blackout '%v' ends before it starts", config.Reason)
+		}
+		schedule.blackouts = append(schedule.blackouts, blackout{from: from, to: to, reason: config.Reason})
+	}
+
+	return schedule, nil
+}
+
+// Allows tells whether deploys may go out at the moment,
+// and otherwise why they may not
+func (schedule *Schedule) Allows(moment time.Time) (bool, string) {
+	if blackout := schedule.getBlackout(moment); blackout != nil {
+		return false, fmt.Sprintf("blackout until %v: %v", blackout.to.In(schedule.location).Format(time.RFC3339), describeReason(blackout.reason))
+	}
+
+	if len(schedule.windows) == 0 {
+		return true, ""
+	}
+
+	local := moment.In(schedule.location)
+	for _, window := range schedule.windows {
+		if window.matches(local) {
+			return true, ""
+		}
+	}
+	return false, "outside the allowed deploy windows"
+}
+
+// Next returns the first allowed moment from the given one on,
+// or the zero time when there is none within a year
+func (schedule *Schedule) Next(moment time.Time) time.Time {
+	if allowed, _ := schedule.Allows(moment); allowed {
+		return moment
+	}
+
+	candidate := moment.Truncate(time.Minute).Add(time.Minute)
+	end := moment.Add(maxScheduleSearch)
+	for candidate.Before(end) {
+		if blackout := schedule.getBlackout(candidate); blackout != nil {
+			candidate = blackout.to
+			continue
+		}
+
+		if allowed, _ := schedule.Allows(candidate); allowed {
+			return candidate
+		}
+		candidate = candidate.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+func (schedule *Schedule) getBlackout(moment time.Time) *blackout {
+	for index := range schedule.blackouts {
+		blackout := &schedule.blackouts[index]
+		if !moment.Before(blackout.from) && moment.Before(blackout.to) {
+			return blackout
+		}
+	}
+	return nil
+}
+
+func (window *cronWindow) matches(moment time.Time) bool {
+	if !window.minutes[moment.Minute()] || !window.hours[moment.Hour()] || !window.months[int(moment.Month())] {
+		return false
+	}
+
+	dayOfMonth := window.daysOfMonth[moment.Day()]
+	dayOfWeek := window.daysOfWeek[int(moment.Weekday())]
+
+	// like cron, a day matches either field when both are restricted
+	if !window.anyDayOfMonth && !window.anyDayOfWeek {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+func parseCronWindow(expression string) (*cronWindow, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Allowed window '%v' needs five fields: minute hour day-of-month month day-of-week", expression)
+	}
+
+	window := &cronWindow{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+
+	var err error
+	window.minutes, err = parseCronField(fields[0], 0, 59, nil)
+	if err == nil {
+		window.hours, err = parseCronField(fields[1], 0, 23, nil)
+	}
+	if err == nil {
+		window.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil)
+	}
+	if err == nil {
+		window.months, err = parseCronField(fields[3], 1, 12, monthNames)
+	}
+	if err == nil {
+		window.daysOfWeek, err = parseCronField(fields[4], 0, 7, dayNames)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Allowed window '%v': %v", expression, err)
+	}
+
+	// 7 is sunday as well
+	if window.daysOfWeek[7] {
+		window.daysOfWeek[0] = true
+	}
+	return window, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges,
+// each with an optional /step
+func parseCronField(field string, min, max int, names map[string]int) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in '%v'", part)
+			}
+			part = part[:slash]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			start, err = parseCronValue(bounds[0], min, max, names)
+			if err != nil {
+				return nil, err
+			}
+
+			end = start
+			if len(bounds) == 2 {
+				end, err = parseCronValue(bounds[1], min, max, names)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if end < start {
+				return nil, fmt.Errorf("range '%v' ends before it starts", part)
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func parseCronValue(value string, min, max int, names map[string]int) (int, error) {
+	if number, ok := names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || number > max {
+		return 0, fmt.Errorf("'%v' is not between %v and %v", value, min, max)
+	}
+	return number, nil
+}
+
+func parseScheduleTime(value string, location *time.Location) (time.Time, error) {
+	moment, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return moment, nil
+	}
+
+	return time.ParseInLocation("2006-01-02 15:04", value, location)
+}
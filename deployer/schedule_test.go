@@ -0,0 +1,115 @@
+package deployer_test
+
+import (
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/octoblu/governator/deployer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schedule", func() {
+	var schedule *deployer.Schedule
+	var err error
+	var phoenix *time.Location
+
+	BeforeEach(func() {
+		phoenix, _ = time.LoadLocation("America/Phoenix")
+		schedule, err = deployer.NewSchedule("America/Phoenix", []string{"* 9-16 * * mon-thu", "* 9-11 * * fri"}, []deployer.Blackout{
+			{From: "2026-11-26 00:00", To: "2026-11-30 00:00", Reason: "thanksgiving traffic"},
+		})
+	})
+
+	It("Should parse", func() {
+		Expect(err).To(BeNil())
+	})
+
+	It("Should allow deploys inside a window", func() {
+		allowed, _ := schedule.Allows(time.Date(2026, 10, 15, 10, 30, 0, 0, phoenix))
+		Expect(allowed).To(BeTrue())
+	})
+
+	It("Should not allow deploys on friday evening", func() {
+		allowed, reason := schedule.Allows(time.Date(2026, 10, 16, 18, 0, 0, 0, phoenix))
+		Expect(allowed).To(BeFalse())
+		Expect(reason).To(Equal("outside the allowed deploy windows"))
+	})
+
+	It("Should read the windows in the time zone of the schedule", func() {
+		allowed, _ := schedule.Allows(time.Date(2026, 10, 15, 17, 30, 0, 0, time.UTC))
+		Expect(allowed).To(BeTrue())
+	})
+
+	It("Should not allow deploys during a blackout", func() {
+		allowed, reason := schedule.Allows(time.Date(2026, 11, 26, 10, 0, 0, 0, phoenix))
+		Expect(allowed).To(BeFalse())
+		Expect(reason).To(Equal("blackout until 2026-11-30T00:00:00-07:00: thanksgiving traffic"))
+	})
+
+	It("Should find the next window after the weekend", func() {
+		next := schedule.Next(time.Date(2026, 10, 16, 18, 0, 0, 0, phoenix))
+		Expect(next).To(Equal(time.Date(2026, 10, 19, 9, 0, 0, 0, phoenix)))
+	})
+
+	It("Should find the next window after a blackout", func() {
+		next := schedule.Next(time.Date(2026, 11, 26, 10, 0, 0, 0, phoenix))
+		Expect(next).To(Equal(time.Date(2026, 11, 30, 9, 0, 0, 0, phoenix)))
+	})
+
+	It("Should reject a window that is not a cron expression", func() {
+		_, err := deployer.NewSchedule("", []string{"* 9-17 * *"}, nil)
+		Expect(err).To(MatchError("Allowed window '* 9-17 * *' needs five fields: minute hour day-of-month month day-of-week"))
+	})
+
+	Describe("When a deploy comes due outside of it", func() {
+		var sut *deployer.Deployer
+		var queue *deployer.MemoryQueue
+		var clock *deployer.ManualClock
+		var etcdClient *FakeEtcdClient
+
+		BeforeEach(func() {
+			clock = deployer.NewManualClock(time.Date(2026, 10, 16, 18, 0, 0, 0, phoenix))
+			queue = deployer.NewMemoryQueue(&deployer.QueueOptions{Clock: clock})
+			etcdClient = &FakeEtcdClient{}
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, Schedule: schedule})
+
+			httpmock.Activate()
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/passed", httpmock.NewStringResponder(200, "Ok"))
+		})
+
+		AfterEach(func() {
+			httpmock.DeactivateAndReset()
+		})
+
+		It("Should hold it in the queue until the next window", func() {
+			queue.Enqueue("deploy-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1"})
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			_, dueAt, _ := queue.NextDue()
+			Expect(dueAt).To(Equal(time.Date(2026, 10, 19, 9, 0, 0, 0, phoenix)))
+		})
+
+		It("Should measure its lateness from when it came due, not from the window", func() {
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/failed", httpmock.NewStringResponder(200, "Ok"))
+			sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, Schedule: schedule, MaxLateness: time.Hour})
+			queue.Enqueue("deploy-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1"})
+			Expect(sut.Run()).To(BeNil())
+
+			clock.Advance(time.Date(2026, 10, 19, 9, 0, 0, 0, phoenix).Sub(clock.Now()))
+			Expect(sut.Run()).To(BeNil())
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("expired"))
+		})
+
+		It("Should deploy it anyway when it is an emergency", func() {
+			queue.Enqueue("deploy-1", clock.Now(), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1", Emergency: true})
+			Expect(sut.Run()).To(BeNil())
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-a")).To(Equal([]string{"octoblu/service-a:v1"}))
+		})
+	})
+})
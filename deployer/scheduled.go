@@ -0,0 +1,56 @@
+package deployer
+
+import (
+	"log"
+	"time"
+)
+
+// holdUnscheduled puts claimed deploys the schedule does not allow right now
+// back on the queue, due when it allows them again. Their lateness still
+// counts from when they first came due, see Claim.DueAt. An emergency
+// deploy goes out anyway, along with the deploys to its etcdDir claimed
+// before it so the etcdDir keeps its order
+func (deployer *Deployer) holdUnscheduled(groups [][]*Claim) ([][]*Claim, error) {
+	if deployer.schedule == nil {
+		return groups, nil
+	}
+
+	now := deployer.clock.Now()
+	allowed, reason := deployer.schedule.Allows(now)
+	if allowed {
+		return groups, nil
+	}
+
+	next := deployer.schedule.Next(now)
+	if next.IsZero() {
+		next = now.Add(maxScheduleSearch)
+	}
+
+	var scheduled [][]*Claim
+	for index, group := range groups {
+		emergencies := 0
+		for index, claim := range group {
+			if claim.Metadata.Emergency {
+				emergencies = index + 1
+			}
+		}
+
+		if emergencies > 0 {
+			log.Printf("deploying %v emergency deploys to %v despite the schedule: %v", emergencies, group[0].Metadata.EtcdDir, reason)
+			scheduled = append(scheduled, group[:emergencies])
+		}
+
+		held := group[emergencies:]
+		if len(held) == 0 {
+			continue
+		}
+
+		log.Printf("holding %v deploys to %v until %v: %v", len(held), held[0].Metadata.EtcdDir, next, reason)
+		err := deployer.requeueDeploys(held, next.Add(-time.Second))
+		if err != nil {
+			return append(append(scheduled, held), groups[index+1:]...), err
+		}
+	}
+
+	return scheduled, nil
+}
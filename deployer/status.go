@@ -0,0 +1,38 @@
+package deployer
+
+// The statuses governator records in the status
+// field of a deploy's hash at <queue>:<deploy>
+const (
+	// StatusPending is a deploy governator put back on the queue
+	StatusPending = "pending"
+
+	// StatusClaimed is a deploy taken off the queue by the instance in claimed:by
+	StatusClaimed = "claimed"
+
+	// StatusDeploying is a deploy whose etcd keys are being written
+	StatusDeploying = "deploying"
+
+	// StatusDone is a deploy that was applied and reported
+	StatusDone = "done"
+
+	// StatusRetrying is a failed deploy that is queued again, see error and attempts
+	StatusRetrying = "retrying"
+
+	// StatusFailed is a deploy governator gave up on, see error
+	StatusFailed = "failed"
+
+	// StatusCancelled is a deploy cancelled while in flight, it was stopped
+	// before touching restart
+	StatusCancelled = "cancelled"
+
+	// StatusSkipped is a deploy that was cancelled before governator got to it,
+	// or that had nothing left to apply, see skipped:reason
+	StatusSkipped = "skipped"
+
+	// StatusSuperseded is a deploy dropped in favour of a newer one for the same etcdDir
+	StatusSuperseded = "superseded"
+
+	// StatusExpired is a deploy claimed after its deadline, it was reported
+	// to the deploy state service as failed instead of rolled out
+	StatusExpired = "expired"
+)
@@ -0,0 +1,539 @@
+package deployer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// streamGroup is the consumer group every governator reads the stream with
+const streamGroup = "governator"
+
+// scheduleScript moves the next due deploy from the zsets into the stream,
+// picked like the claim script of a RedisQueue does: urgent deploys first,
+// unless a normal deploy has been due since before the starvation deadline.
+// It only moves one while no entry waits undelivered in the stream, since
+// the stream is read in order and an urgent deploy moved in later would
+// wait behind every entry before it. Acked entries are deleted, so the
+// entries not pending for the group are the undelivered ones. The lane goes
+// along so a retry ends up in the same zset, and the score it was first
+// moved at, kept as due:at like the claim script does
+//
+// KEYS[1] deploys zset, KEYS[2] urgent deploys zset, KEYS[3] stream
+// ARGV[1] now, ARGV[2] starvation deadline, ARGV[3] consumer group,
+// ARGV[4] deploy key prefix
+var scheduleScript = redis.NewScript(3, `
+local pending = redis.call('XPENDING', KEYS[3], ARGV[3])
+if redis.call('XLEN', KEYS[3]) > tonumber(pending[1]) then
+  return 0
+end
+
+local deploy, lane, dueAt
+local normal = redis.call('ZRANGEBYSCORE', KEYS[1], 0, ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1)
+if normal[1] and tonumber(normal[2]) <= tonumber(ARGV[2]) then
+  deploy, lane, dueAt = normal[1], {KEYS[1], 'normal'}, normal[2]
+else
+  local urgent = redis.call('ZRANGEBYSCORE', KEYS[2], 0, ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1)
+  if urgent[1] then
+    deploy, lane, dueAt = urgent[1], {KEYS[2], 'urgent'}, urgent[2]
+  elseif normal[1] then
+    deploy, lane, dueAt = normal[1], {KEYS[1], 'normal'}, normal[2]
+  else
+    return 0
+  end
+end
+
+redis.call('ZREM', lane[1], deploy)
+local deployKey = ARGV[4] .. deploy
+redis.call('HSETNX', deployKey, 'due:at', dueAt)
+dueAt = redis.call('HGET', deployKey, 'due:at')
+redis.call('XADD', KEYS[3], '*', 'deploy', deploy, 'lane', lane[2], 'due', dueAt)
+return 1
+`)
+
+// renewEntryScript resets the idle time of an entry, but only while it is
+// pending for this instance. Once it was reclaimed by another governator
+// or acked it returns 0
+//
+// KEYS[1] stream
+// ARGV[1] consumer group, ARGV[2] instance id, ARGV[3] entry id
+var renewEntryScript = redis.NewScript(1, `
+local pending = redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[3], ARGV[3], 1, ARGV[2])
+if #pending == 0 then
+  return 0
+end
+
+redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[2], 0, ARGV[3], 'JUSTID')
+return 1
+`)
+
+// StreamQueue takes deploys from the <queue>:governator:stream redis stream
+// through a consumer group, so several governators share the work. The
+// producer keeps writing to the zsets of a RedisQueue, the next due deploy
+// is moved into the stream on every Claim along with the score it was due
+// at. An entry is acked only once its deploy finished, entries of a
+// governator that died are reclaimed after the lease. Recover still looks
+// after deploys claimed from the zsets before the switch
+type StreamQueue struct {
+	*RedisQueue
+	groupReady bool
+	groupMutex sync.Mutex
+}
+
+// streamEntry is an entry read from the stream
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// NewStreamQueue constructs a queue on top of a redis stream, options may be nil
+func NewStreamQueue(redisPool *redis.Pool, queueName string, options *QueueOptions) *StreamQueue {
+	return &StreamQueue{RedisQueue: NewRedisQueue(redisPool, queueName, options)}
+}
+
+// NextDue returns now while the stream has entries nobody read yet,
+// otherwise the earliest deploy still waiting in the zsets
+func (queue *StreamQueue) NextDue() (string, time.Time, error) {
+	redisConn := queue.redisPool.Get()
+	undelivered, err := queue.hasUndelivered(redisConn)
+	redisConn.Close()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if undelivered {
+		return queue.getKey("governator:stream"), queue.clock.Now(), nil
+	}
+	return queue.RedisQueue.NextDue()
+}
+
+// Claim moves the next due deploy into the stream, then takes an entry
+// that stayed unacked past the lease or else a new one
+func (queue *StreamQueue) Claim() (*Claim, error) {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	err := queue.createGroup(redisConn)
+	if err != nil {
+		return nil, err
+	}
+
+	now := queue.clock.Now()
+	_, err = scheduleScript.Do(
+		redisConn,
+		queue.getKey("governator:deploys"),
+		queue.getKey("governator:deploys:urgent"),
+		queue.getKey("governator:stream"),
+		now.Unix(),
+		now.Add(-queue.maxNormalDelay).Unix(),
+		streamGroup,
+		queue.getKey(""),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		entry, reclaimed, err := queue.nextEntry(redisConn)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			return nil, nil
+		}
+
+		claim, err := queue.claimEntry(redisConn, entry, reclaimed)
+		if err != nil {
+			return nil, err
+		}
+
+		if claim != nil {
+			return claim, nil
+		}
+	}
+}
+
+// Renew resets how long the deploy's entry has been idle, which renews its
+// lease, as long as the entry is still pending for this instance
+func (queue *StreamQueue) Renew(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	return queue.renewEntry(redisConn, deploy)
+}
+
+// Start renews the lease of the deploy's entry
+// and records that it is being deployed
+func (queue *StreamQueue) Start(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	err := queue.renewEntry(redisConn, deploy)
+	if err != nil {
+		return err
+	}
+
+	err = queue.recordApplied(redisConn, deploy, StatusDeploying)
+	if err != nil {
+		return err
+	}
+
+	return queue.setStatus(redisConn, deploy, StatusDeploying)
+}
+
+// Ack records how the deploy finished and acks its entry
+func (queue *StreamQueue) Ack(deploy, status string, fields ...string) error {
+	err := queue.RedisQueue.Ack(deploy, status, fields...)
+	if err != nil {
+		return err
+	}
+
+	return queue.ackEntry(deploy)
+}
+
+// Fail schedules the deploy again in its zset, or dead letters it,
+// and acks its entry
+func (queue *StreamQueue) Fail(deploy string, cause error) (time.Time, error) {
+	retryAt, err := queue.RedisQueue.Fail(deploy, cause)
+	if err != nil {
+		return retryAt, err
+	}
+
+	return retryAt, queue.ackEntry(deploy)
+}
+
+// Requeue puts the deploy back in its zset and acks its entry
+func (queue *StreamQueue) Requeue(deploy string, dueAt time.Time) error {
+	err := queue.RedisQueue.Requeue(deploy, dueAt)
+	if err != nil {
+		return err
+	}
+
+	return queue.ackEntry(deploy)
+}
+
+// createGroup creates the consumer group, and the stream with it,
+// the first time this queue talks to redis
+func (queue *StreamQueue) createGroup(redisConn redis.Conn) error {
+	queue.groupMutex.Lock()
+	defer queue.groupMutex.Unlock()
+
+	if queue.groupReady {
+		return nil
+	}
+
+	_, err := redisConn.Do("XGROUP", "CREATE", queue.getKey("governator:stream"), streamGroup, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	queue.groupReady = true
+	return nil
+}
+
+// nextEntry reclaims an entry whose lease ran out, or reads a new one
+func (queue *StreamQueue) nextEntry(redisConn redis.Conn) (*streamEntry, bool, error) {
+	stream := queue.getKey("governator:stream")
+	minIdle := int64(queue.leaseDuration / time.Millisecond)
+
+	reply, err := redis.Values(redisConn.Do("XAUTOCLAIM", stream, streamGroup, queue.instanceID, minIdle, "0-0", "COUNT", 1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(reply) > 1 {
+		entries, err := parseStreamEntries(reply[1])
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, entry := range entries {
+			// redis before 7 reclaims entries that were deleted meanwhile
+			if entry.fields == nil {
+				err = queue.removeEntry(redisConn, entry.id)
+				if err != nil {
+					return nil, false, err
+				}
+				continue
+			}
+			return entry, true, nil
+		}
+	}
+
+	reply, err = redis.Values(redisConn.Do("XREADGROUP", "GROUP", streamGroup, queue.instanceID, "COUNT", 1, "STREAMS", stream, ">"))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, streamReply := range reply {
+		values, err := redis.Values(streamReply, nil)
+		if err != nil || len(values) != 2 {
+			return nil, false, fmt.Errorf("unexpected XREADGROUP reply: %v", reply)
+		}
+
+		entries, err := parseStreamEntries(values[1])
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(entries) > 0 {
+			return entries[0], false, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// claimEntry records the deploy of an entry as claimed. Like the claim script
+// of a RedisQueue it skips cancelled deploys, and it gives up on a reclaimed
+// deploy that was abandoned too many times by returning a nil claim
+func (queue *StreamQueue) claimEntry(redisConn redis.Conn, entry *streamEntry, reclaimed bool) (*Claim, error) {
+	deploy := entry.fields["deploy"]
+	now := queue.clock.Now().Unix()
+
+	if reclaimed {
+		recoveries, err := redis.Int(redisConn.Do("HINCRBY", queue.getKey(deploy), "lease:recoveries", 1))
+		if err != nil {
+			return nil, err
+		}
+
+		if recoveries > queue.maxLeaseRecoveries {
+			debug("Deploy abandoned too many times, marking failed: %v", deploy)
+			errorMessage := fmt.Sprintf("lease expired %v times", recoveries)
+			err = queue.setStatus(redisConn, deploy, StatusFailed, "finished:at", now, "error", errorMessage)
+			if err != nil {
+				return nil, err
+			}
+			err = queue.expire(redisConn, deploy)
+			if err != nil {
+				return nil, err
+			}
+			return nil, queue.removeEntry(redisConn, entry.id)
+		}
+	}
+
+	cancelled, err := redis.Bool(redisConn.Do("HEXISTS", queue.getKey(deploy), "cancellation"))
+	if err != nil {
+		return nil, err
+	}
+
+	if cancelled {
+		debug("Deploy was cancelled: %v", deploy)
+		err = queue.setStatus(redisConn, deploy, StatusSkipped, "finished:at", now)
+		if err != nil {
+			return nil, err
+		}
+		err = queue.expire(redisConn, deploy)
+		if err != nil {
+			return nil, err
+		}
+		return &Claim{Deploy: deploy, Cancelled: true}, queue.removeEntry(redisConn, entry.id)
+	}
+
+	metadata, err := queue.Metadata(deploy)
+	if err != nil {
+		queue.removeEntry(redisConn, entry.id)
+		return nil, err
+	}
+
+	restarted, err := redis.Bool(redisConn.Do("HEXISTS", queue.getKey(deploy), "restarted:at"))
+	if err != nil {
+		return nil, err
+	}
+
+	var dueAt time.Time
+	if due, ok := entry.fields["due"]; ok {
+		dueAt, err = parseScore(due)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	debug("claimed: %v", deploy)
+	err = queue.setStatus(redisConn, deploy, StatusClaimed, "claimed:by", queue.instanceID, "claimed:at", now, "lane", entry.fields["lane"], "stream:id", entry.id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Claim{Deploy: deploy, Metadata: metadata, DueAt: dueAt, Restarted: restarted}, nil
+}
+
+// renewEntry renews the lease of a deploy, those claimed from the zsets
+// before the switch have no entry and are renewed like in a RedisQueue
+func (queue *StreamQueue) renewEntry(redisConn redis.Conn, deploy string) error {
+	id, err := queue.getEntryID(redisConn, deploy)
+	if err != nil {
+		return err
+	}
+
+	if id == "" {
+		return queue.renew(redisConn, deploy)
+	}
+
+	renewed, err := redis.Int(renewEntryScript.Do(redisConn, queue.getKey("governator:stream"), streamGroup, queue.instanceID, id))
+	if err != nil {
+		return err
+	}
+
+	if renewed == 0 {
+		return &lostLeaseError{deploy: deploy}
+	}
+	return nil
+}
+
+// ackEntry acks and deletes the entry the deploy was claimed from
+func (queue *StreamQueue) ackEntry(deploy string) error {
+	redisConn := queue.redisPool.Get()
+	defer redisConn.Close()
+
+	id, err := queue.getEntryID(redisConn, deploy)
+	if err != nil || id == "" {
+		return err
+	}
+
+	err = queue.removeEntry(redisConn, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("HDEL", queue.getKey(deploy), "stream:id")
+	return err
+}
+
+func (queue *StreamQueue) removeEntry(redisConn redis.Conn, id string) error {
+	stream := queue.getKey("governator:stream")
+	_, err := redisConn.Do("XACK", stream, streamGroup, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("XDEL", stream, id)
+	return err
+}
+
+// getEntryID returns the id of the entry the deploy was claimed from,
+// empty for a deploy claimed before the stream backend was used
+func (queue *StreamQueue) getEntryID(redisConn redis.Conn, deploy string) (string, error) {
+	id, err := redis.String(redisConn.Do("HGET", queue.getKey(deploy), "stream:id"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return id, err
+}
+
+// hasUndelivered tells whether the stream has entries past the
+// last one delivered to the consumer group
+func (queue *StreamQueue) hasUndelivered(redisConn redis.Conn) (bool, error) {
+	stream := queue.getKey("governator:stream")
+
+	last, err := redis.Values(redisConn.Do("XREVRANGE", stream, "+", "-", "COUNT", 1))
+	if err != nil {
+		return false, err
+	}
+
+	entries, err := parseStreamEntries(last)
+	if err != nil || len(entries) == 0 {
+		return false, err
+	}
+
+	groups, err := redis.Values(redisConn.Do("XINFO", "GROUPS", stream))
+	if err != nil {
+		return false, err
+	}
+
+	for _, group := range groups {
+		info := stringFields(group)
+		if info["name"] == streamGroup {
+			return compareStreamIDs(entries[0].id, info["last-delivered-id"]) > 0, nil
+		}
+	}
+	return true, nil
+}
+
+// parseStreamEntries parses a list of [id, [field, value, ...]] entries,
+// entries that were deleted come without fields
+func parseStreamEntries(reply interface{}) ([]*streamEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*streamEntry
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+
+		parts, err := redis.Values(value, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry: %v", value)
+		}
+
+		id, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &streamEntry{id: id}
+		if parts[1] != nil {
+			entry.fields, err = redis.StringMap(parts[1], nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// stringFields turns a name, value reply into a map, leaving out non string values
+func stringFields(reply interface{}) map[string]string {
+	fields := make(map[string]string)
+	values, _ := redis.Values(reply, nil)
+
+	for index := 0; index+1 < len(values); index += 2 {
+		name, err := redis.String(values[index], nil)
+		if err != nil {
+			continue
+		}
+
+		value, err := redis.String(values[index+1], nil)
+		if err != nil {
+			continue
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+// compareStreamIDs compares two <milliseconds>-<sequence> stream ids
+func compareStreamIDs(left, right string) int {
+	leftParts := strings.SplitN(left, "-", 2)
+	rightParts := strings.SplitN(right, "-", 2)
+
+	for index := 0; index < 2; index++ {
+		var leftPart, rightPart uint64
+		if index < len(leftParts) {
+			leftPart, _ = strconv.ParseUint(leftParts[index], 10, 64)
+		}
+		if index < len(rightParts) {
+			rightPart, _ = strconv.ParseUint(rightParts[index], 10, 64)
+		}
+
+		if leftPart != rightPart {
+			if leftPart < rightPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+package deployer_test
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StreamQueue", func() {
+	var queue *deployer.StreamQueue
+	var redisConn *redigomock.Conn
+	var claim *deployer.Claim
+	var err error
+
+	BeforeEach(func() {
+		redisConn = redigomock.NewConn()
+		redisConn.GenericCommand("EXPIRE")
+		redisConn.GenericCommand("GET")
+		redisConn.GenericCommand("SET")
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
+		queue = deployer.NewStreamQueue(redisPool, "redis-queue:name", &deployer.QueueOptions{
+			InstanceID:         "governator-1",
+			MaxLeaseRecoveries: 2,
+			MaxNormalDelay:     10 * time.Minute,
+			Clock:              deployer.NewManualClock(time.Unix(5000, 0)),
+		})
+
+		redisConn.Command("XGROUP", "CREATE", "redis-queue:name:governator:stream", "governator", "0", "MKSTREAM").Expect("OK")
+		redisConn.GenericCommand("EVALSHA").Expect(int64(1))
+		redisConn.GenericCommand("HMSET").Expect("OK")
+		redisConn.Command("HEXISTS", "redis-queue:name:deploy-1", "restarted:at").Expect(int64(0))
+		redisConn.Command("HGET", "redis-queue:name:deploy-1", "request:metadata").Expect([]byte(`{"etcdDir":"/octoblu/service-a","dockerUrl":"octoblu/service-a:v1"}`))
+	})
+
+	Describe("When a new entry is in the stream", func() {
+		var statusClaimed, schedule *redigomock.Cmd
+
+		BeforeEach(func() {
+			redisConn.GenericCommand("XAUTOCLAIM").Expect([]interface{}{[]byte("0-0"), []interface{}{}})
+			redisConn.Command("XREADGROUP", "GROUP", "governator", "governator-1", "COUNT", 1, "STREAMS", "redis-queue:name:governator:stream", ">").Expect([]interface{}{
+				[]interface{}{
+					[]byte("redis-queue:name:governator:stream"),
+					[]interface{}{streamEntry("1-0", "deploy-1", "urgent")},
+				},
+			})
+			redisConn.Command("HEXISTS", "redis-queue:name:deploy-1", "cancellation").Expect(int64(0))
+			schedule = redisConn.Command("EVALSHA", redigomock.NewAnyData(), 3,
+				"redis-queue:name:governator:deploys", "redis-queue:name:governator:deploys:urgent", "redis-queue:name:governator:stream",
+				int64(5000), int64(4400), "governator", "redis-queue:name:").Expect(int64(1))
+			statusClaimed = redisConn.Command("HMSET", "redis-queue:name:deploy-1", "status", "claimed", "claimed:by", "governator-1", "claimed:at", redigomock.NewAnyInt(), "lane", "urgent", "stream:id", "1-0").Expect("OK")
+			claim, err = queue.Claim()
+		})
+
+		It("Should claim its deploy", func() {
+			Expect(err).To(BeNil())
+			Expect(claim.Deploy).To(Equal("deploy-1"))
+			Expect(claim.Metadata.DockerURL).To(Equal("octoblu/service-a:v1"))
+		})
+
+		It("Should move the next due deploy into the stream, minding starved normal deploys", func() {
+			Expect(redisConn.Stats(schedule)).To(Equal(1), "EVALSHA was not called with the starvation deadline")
+		})
+
+		It("Should remember the entry and the lane", func() {
+			Expect(redisConn.Stats(statusClaimed)).To(Equal(1), "HMSET was not called enough times")
+		})
+
+		Describe("When the deploy is acked", func() {
+			var xack, xdel *redigomock.Cmd
+
+			BeforeEach(func() {
+				redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "deploy-1").Expect(int64(0))
+				redisConn.Command("HGET", "redis-queue:name:deploy-1", "stream:id").Expect([]byte("1-0"))
+				xack = redisConn.Command("XACK", "redis-queue:name:governator:stream", "governator", "1-0").Expect(int64(1))
+				xdel = redisConn.Command("XDEL", "redis-queue:name:governator:stream", "1-0").Expect(int64(1))
+				redisConn.Command("HDEL", "redis-queue:name:deploy-1", "stream:id").Expect(int64(1))
+				err = queue.Ack("deploy-1", deployer.StatusDone)
+			})
+
+			It("Should ack and delete the entry", func() {
+				Expect(err).To(BeNil())
+				Expect(redisConn.Stats(xack)).To(Equal(1), "XACK was not called enough times")
+				Expect(redisConn.Stats(xdel)).To(Equal(1), "XDEL was not called enough times")
+			})
+		})
+	})
+
+	Describe("When an entry stayed unacked past the lease", func() {
+		var hincrby *redigomock.Cmd
+
+		BeforeEach(func() {
+			redisConn.GenericCommand("XAUTOCLAIM").
+				Expect([]interface{}{[]byte("0-0"), []interface{}{streamEntry("1-0", "deploy-1", "normal")}}).
+				Expect([]interface{}{[]byte("0-0"), []interface{}{}})
+			redisConn.GenericCommand("XREADGROUP").Expect(nil)
+			redisConn.Command("HEXISTS", "redis-queue:name:deploy-1", "cancellation").Expect(int64(0))
+			redisConn.GenericCommand("XACK").Expect(int64(1))
+			redisConn.GenericCommand("XDEL").Expect(int64(1))
+		})
+
+		Describe("When it was abandoned before", func() {
+			BeforeEach(func() {
+				hincrby = redisConn.Command("HINCRBY", "redis-queue:name:deploy-1", "lease:recoveries", 1).Expect(int64(1))
+				claim, err = queue.Claim()
+			})
+
+			It("Should reclaim its deploy", func() {
+				Expect(err).To(BeNil())
+				Expect(claim.Deploy).To(Equal("deploy-1"))
+				Expect(redisConn.Stats(hincrby)).To(Equal(1), "HINCRBY was not called enough times")
+			})
+		})
+
+		Describe("When it was abandoned too many times", func() {
+			var statusFailed *redigomock.Cmd
+
+			BeforeEach(func() {
+				redisConn.Command("HINCRBY", "redis-queue:name:deploy-1", "lease:recoveries", 1).Expect(int64(3))
+				statusFailed = redisConn.Command("HMSET", "redis-queue:name:deploy-1", "status", "failed", "finished:at", redigomock.NewAnyInt(), "error", "lease expired 3 times").Expect("OK")
+				claim, err = queue.Claim()
+			})
+
+			It("Should mark it failed instead of claiming it", func() {
+				Expect(err).To(BeNil())
+				Expect(claim).To(BeNil())
+				Expect(redisConn.Stats(statusFailed)).To(Equal(1), "HMSET was not called enough times")
+			})
+		})
+	})
+})
+
+func streamEntry(id, deploy, lane string) []interface{} {
+	return []interface{}{
+		[]byte(id),
+		[]interface{}{[]byte("deploy"), []byte(deploy), []byte("lane"), []byte(lane)},
+	}
+}
@@ -0,0 +1,35 @@
+package deployer
+
+// supersedeGroups keeps only the newest deploy of every etcdDir,
+// the older ones are marked superseded and released. Deploys carrying
+// env changes are kept along with it, the newest would not make them
+func (deployer *Deployer) supersedeGroups(groups [][]*Claim) ([][]*Claim, error) {
+	newestGroups := make([][]*Claim, 0, len(groups))
+
+	for index, group := range groups {
+		newest := group[len(group)-1]
+
+		var kept []*Claim
+		for claimIndex, claim := range group[:len(group)-1] {
+			if claim.Metadata.hasEnvChanges() {
+				kept = append(kept, claim)
+				continue
+			}
+
+			err := deployer.supersedeDeploy(claim.Deploy, newest.Deploy)
+			if err != nil {
+				remaining := append(kept, group[claimIndex:]...)
+				return append(append(newestGroups, remaining), groups[index+1:]...), err
+			}
+		}
+
+		newestGroups = append(newestGroups, append(kept, newest))
+	}
+
+	return newestGroups, nil
+}
+
+func (deployer *Deployer) supersedeDeploy(deploy, newest string) error {
+	debug("supersedeDeploy: %v by %v", deploy, newest)
+	return deployer.ack(deploy, StatusSuperseded, "superseded", newest)
+}
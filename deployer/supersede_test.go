@@ -0,0 +1,85 @@
+package deployer_test
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/jarcoal/httpmock"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Supersede", func() {
+	var sut *deployer.Deployer
+	var redisConn *redigomock.Conn
+	var etcdClient *FakeEtcdClient
+	var err error
+	var supersede1, supersede2, supersede3 *redigomock.Cmd
+	var release1, release2, release3 *redigomock.Cmd
+
+	BeforeEach(func() {
+		httpmock.Activate()
+		redisConn = redigomock.NewConn()
+		redisConn.GenericCommand("EXPIRE")
+		redisConn.GenericCommand("GET")
+		redisConn.GenericCommand("SET")
+		noReleases(redisConn)
+		redisConn.GenericCommand("HSET")
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
+		etcdClient = &FakeEtcdClient{}
+		queue := deployer.NewRedisQueue(redisPool, "redis-queue:name", &deployer.QueueOptions{InstanceID: "governator-1"})
+		sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{
+			Supersede: true,
+		})
+
+		redisConn.GenericCommand("EVALSHA").
+			Expect(claimedReply("deploy-1", "/octoblu/service-a", "octoblu/service-a:v1")).
+			Expect(claimedReply("deploy-2", "/octoblu/service-a", "octoblu/service-a:v2")).
+			Expect(claimedReply("deploy-3", "/octoblu/service-a", "octoblu/service-a:v3")).
+			Expect(nil)
+		redisConn.GenericCommand("ZADD").Expect(int64(0))
+		renewedLease(redisConn, "deploy-3")
+		redisConn.GenericCommand("HEXISTS").Expect(int64(0)).Expect(int64(0)).Expect(int64(0)).Expect(int64(0))
+		redisConn.GenericCommand("HMSET")
+		supersede1 = redisConn.Command("HMSET", "redis-queue:name:deploy-1", "status", "superseded", "finished:at", redigomock.NewAnyInt(), "superseded", "deploy-3").Expect("OK")
+		supersede2 = redisConn.Command("HMSET", "redis-queue:name:deploy-2", "status", "superseded", "finished:at", redigomock.NewAnyInt(), "superseded", "deploy-3").Expect("OK")
+		supersede3 = redisConn.Command("HMSET", "redis-queue:name:deploy-3", "status", "superseded", "finished:at", redigomock.NewAnyInt(), "superseded", "deploy-3").Expect("OK")
+		release1 = redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "deploy-1").Expect(int64(1))
+		release2 = redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "deploy-2").Expect(int64(1))
+		release3 = redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "deploy-3").Expect(int64(1))
+
+		rsp := httpmock.NewStringResponder(200, "Ok")
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v3/cluster/super/passed", rsp)
+
+		err = sut.Run()
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	It("Should not error", func() {
+		Expect(err).To(BeNil())
+	})
+
+	It("Should only deploy the newest version", func() {
+		Expect(dockerURLsFor(etcdClient, "/octoblu/service-a")).To(Equal([]string{"octoblu/service-a:v3"}))
+	})
+
+	It("Should restart the service once", func() {
+		Expect(etcdClient.SetCalls).To(HaveLen(3))
+	})
+
+	It("Should mark the older deploys superseded", func() {
+		Expect(redisConn.Stats(supersede1)).To(Equal(1), "HMSET was not called for deploy-1")
+		Expect(redisConn.Stats(supersede2)).To(Equal(1), "HMSET was not called for deploy-2")
+		Expect(redisConn.Stats(supersede3)).To(Equal(0))
+	})
+
+	It("Should release every deploy", func() {
+		Expect(redisConn.Stats(release1)).To(Equal(1), "ZREM was not called for deploy-1")
+		Expect(redisConn.Stats(release2)).To(Equal(1), "ZREM was not called for deploy-2")
+		Expect(redisConn.Stats(release3)).To(Equal(1), "ZREM was not called for deploy-3")
+	})
+})
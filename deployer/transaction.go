@@ -0,0 +1,72 @@
+package deployer
+
+import "log"
+
+// etcdTransaction writes keys with compare-and-swap and remembers what they
+// held before, so a deploy that does not get through can put them back
+type etcdTransaction struct {
+	etcdClient EtcdClient
+	writes     []etcdWrite
+}
+
+// etcdWrite is a key as it was before the transaction wrote it and after
+type etcdWrite struct {
+	key      string
+	previous EtcdValue
+	next     EtcdValue
+}
+
+func newEtcdTransaction(etcdClient EtcdClient) *etcdTransaction {
+	return &etcdTransaction{etcdClient: etcdClient}
+}
+
+// set snapshots the key and swaps in the value, it fails when
+// the key changed between the snapshot and the swap
+func (transaction *etcdTransaction) set(key, value string) error {
+	return transaction.swap(key, EtcdValue{Value: value, Exists: true})
+}
+
+// unset snapshots the key and deletes it the same way
+func (transaction *etcdTransaction) unset(key string) error {
+	return transaction.swap(key, EtcdValue{})
+}
+
+func (transaction *etcdTransaction) swap(key string, next EtcdValue) error {
+	previous, err := transaction.etcdClient.Lookup(key)
+	if err != nil {
+		return err
+	}
+
+	err = transaction.etcdClient.CompareAndSwap(key, previous, next)
+	if err != nil {
+		return err
+	}
+
+	transaction.writes = append(transaction.writes, etcdWrite{key: key, previous: previous, next: next})
+	return nil
+}
+
+// previous returns what a key written by the transaction held before
+func (transaction *etcdTransaction) previous(key string) EtcdValue {
+	for _, write := range transaction.writes {
+		if write.key == key {
+			return write.previous
+		}
+	}
+	return EtcdValue{}
+}
+
+// rollback restores the snapshots in reverse order. A key that changed
+// since it was written is left alone, it is not ours anymore
+func (transaction *etcdTransaction) rollback() {
+	for index := len(transaction.writes) - 1; index >= 0; index-- {
+		write := transaction.writes[index]
+		err := transaction.etcdClient.CompareAndSwap(write.key, write.next, write.previous)
+		if err != nil {
+			log.Printf("could not roll back %v: %v", write.key, err)
+			continue
+		}
+		debug("rolled back %v", write.key)
+	}
+	transaction.writes = nil
+}
@@ -0,0 +1,147 @@
+package deployer
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultVerifyTimeout is how long a deploy gets to report healthy,
+// it stays within DefaultLeaseDuration
+const DefaultVerifyTimeout = 3 * time.Minute
+
+// Verification waits after the restart for the service to publish a key
+// under its etcdDir, like a healthy status or the version it runs, before
+// the deploy is reported passed. The key and value are templates like
+// those of a KeyTemplate
+type Verification struct {
+	expected *keyTemplate
+	timeout  time.Duration
+	rollback bool
+}
+
+// unverifiedError stops a deploy whose service never reported healthy,
+// it was reported failed already and is not retried
+type unverifiedError struct {
+	deploy     string
+	expected   etcdKey
+	timeout    time.Duration
+	cause      error
+	rolledBack bool
+}
+
+func (err *unverifiedError) Error() string {
+	message := fmt.Sprintf("Deploy '%v' did not set %v to '%v' within %v", err.deploy, err.expected.step, err.expected.value, err.timeout)
+	if err.cause != nil {
+		message = fmt.Sprintf("Deploy '%v' could not be verified: %v", err.deploy, err.cause)
+	}
+
+	if err.rolledBack {
+		return message + ", rolled back"
+	}
+	return message
+}
+
+// NewVerification parses the key to wait for and its value, which may not
+// be empty since a deleted key reads as empty. A zero timeout is
+// DefaultVerifyTimeout, rollback puts the keys of a deploy that was not
+// verified back the way they were
+func NewVerification(key, value string, timeout time.Duration, rollback bool) (*Verification, error) {
+	if value == "" {
+		return nil, fmt.Errorf("Verification needs a value to wait for")
+	}
+
+	expected, err := parseKeyTemplate(KeyTemplate{Key: key, Value: value})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = expected.render(exampleKeyData())
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout == 0 {
+		timeout = DefaultVerifyTimeout
+	}
+	return &Verification{expected: expected, timeout: timeout, rollback: rollback}, nil
+}
+
+// watchVerification starts watching the etcdDir of a deploy, it is called
+// before the last key is written so the service cannot report healthy
+// unseen. Without a Verification there is nothing to watch
+func (deployer *Deployer) watchVerification(etcdDir string, done <-chan struct{}) (<-chan EtcdChange, error) {
+	if deployer.verification == nil {
+		return nil, nil
+	}
+	return deployer.etcdClient.WatchRecursive(etcdDir, done)
+}
+
+// verify waits for the service to set the key of the Verification to
+// its value, a deploy that does not in time is not verified. The lease of
+// the deploy is renewed while it waits, once it is lost the deploy is
+// left to whoever claimed it again
+func (deployer *Deployer) verify(claim *Claim, transaction *etcdTransaction, changes <-chan EtcdChange) error {
+	verification := deployer.verification
+	if verification == nil {
+		return nil
+	}
+
+	metadata := claim.Metadata
+	expected, err := verification.expected.render(newKeyData(metadata.EtcdDir, metadata.DockerURL, claim.Deploy, deployer.cluster, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	unverified := &unverifiedError{deploy: claim.Deploy, expected: expected, timeout: verification.timeout}
+	timer := time.NewTimer(verification.timeout)
+	defer timer.Stop()
+	renewal := time.NewTicker(deployer.leaseDuration / 3)
+	defer renewal.Stop()
+
+	debug("verify: waiting for %v to be %v", expected.key, expected.value)
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				unverified.cause = fmt.Errorf("the watch of %v ended", metadata.EtcdDir)
+				return deployer.failVerification(claim, transaction, unverified)
+			}
+
+			if change.Err != nil {
+				unverified.cause = change.Err
+				return deployer.failVerification(claim, transaction, unverified)
+			}
+
+			if change.Key == expected.key && change.Value == expected.value {
+				debug("verify: %v is %v", expected.key, expected.value)
+				return nil
+			}
+		case <-renewal.C:
+			err = deployer.queue.Renew(claim.Deploy)
+			if _, ok := err.(*lostLeaseError); ok {
+				return err
+			}
+			if err != nil {
+				log.Printf("could not renew the lease of %v: %v", claim.Deploy, err)
+			}
+		case <-timer.C:
+			return deployer.failVerification(claim, transaction, unverified)
+		}
+	}
+}
+
+// failVerification reports the deploy failed and, when the Verification
+// says so, puts the keys it wrote back
+func (deployer *Deployer) failVerification(claim *Claim, transaction *etcdTransaction, unverified *unverifiedError) error {
+	err := deployer.notifyDeployState(claim.Metadata.DockerURL, "failed")
+	if err != nil {
+		log.Printf("could not report %v failed: %v", claim.Deploy, err)
+	}
+
+	if deployer.verification.rollback {
+		transaction.rollback()
+		unverified.rolledBack = true
+	}
+	return unverified
+}
@@ -0,0 +1,160 @@
+package deployer_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/octoblu/governator/deployer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verification", func() {
+	var queue *deployer.MemoryQueue
+	var clock *deployer.ManualClock
+	var etcdClient *FakeEtcdClient
+	var results []string
+	var err error
+
+	newDeployer := func(rollback bool) *deployer.Deployer {
+		verification, _ := deployer.NewVerification("{{.EtcdDir}}/running_version", "{{.Tag}}", 50*time.Millisecond, rollback)
+		return deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{Clock: clock, Verification: verification})
+	}
+
+	BeforeEach(func() {
+		results = nil
+		httpmock.Activate()
+		for _, result := range []string{"passed", "failed"} {
+			result := result
+			httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/"+result, func(*http.Request) (*http.Response, error) {
+				results = append(results, result)
+				return httpmock.NewStringResponse(200, "Ok"), nil
+			})
+		}
+
+		clock = deployer.NewManualClock(time.Unix(1000, 0))
+		queue = deployer.NewMemoryQueue(&deployer.QueueOptions{Clock: clock})
+		etcdClient = &FakeEtcdClient{Values: map[string]string{
+			"/octoblu/service-a/docker_url":         "octoblu/service-a:v0",
+			"/octoblu/service-a/env/SENTRY_RELEASE": "v0",
+			"/octoblu/service-a/restart":            "earlier",
+		}}
+		queue.Enqueue("deploy-1", time.Unix(1000, 0), &deployer.RequestMetadata{EtcdDir: "/octoblu/service-a", DockerURL: "octoblu/service-a:v1"})
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	Describe("When the service reports the new version after the restart", func() {
+		BeforeEach(func() {
+			etcdClient.OnSet = func(key string) {
+				if key == "/octoblu/service-a/restart" {
+					etcdClient.Publish("/octoblu/service-a/running_version", "v0")
+					etcdClient.Publish("/octoblu/service-a/running_version", "v1")
+				}
+			}
+			err = newDeployer(true).Run()
+		})
+
+		It("Should report it passed", func() {
+			Expect(err).To(BeNil())
+			Expect(results).To(Equal([]string{"passed"}))
+		})
+
+		It("Should record it as done", func() {
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("done"))
+		})
+	})
+
+	Describe("When the service never reports the new version", func() {
+		Describe("without rollback", func() {
+			BeforeEach(func() {
+				err = newDeployer(false).Run()
+			})
+
+			It("Should report it failed", func() {
+				Expect(err).To(BeNil())
+				Expect(results).To(Equal([]string{"failed"}))
+			})
+
+			It("Should fail it without a retry", func() {
+				fields, _ := queue.InspectDeploy("deploy-1")
+				Expect(fields["status"]).To(Equal("failed"))
+				Expect(fields["error"]).To(Equal("Deploy 'deploy-1' did not set running_version to 'v1' within 50ms"))
+			})
+
+			It("Should leave the new docker url", func() {
+				Expect(etcdClient.Values["/octoblu/service-a/docker_url"]).To(Equal("octoblu/service-a:v1"))
+			})
+
+			It("Should not record a release", func() {
+				releases, _ := queue.Releases("/octoblu/service-a")
+				Expect(releases).To(BeEmpty())
+			})
+		})
+
+		Describe("with rollback", func() {
+			BeforeEach(func() {
+				err = newDeployer(true).Run()
+			})
+
+			It("Should put the keys back", func() {
+				Expect(err).To(BeNil())
+				Expect(etcdClient.Values).To(Equal(map[string]string{
+					"/octoblu/service-a/docker_url":         "octoblu/service-a:v0",
+					"/octoblu/service-a/env/SENTRY_RELEASE": "v0",
+					"/octoblu/service-a/restart":            "earlier",
+				}))
+			})
+
+			It("Should say it rolled back", func() {
+				fields, _ := queue.InspectDeploy("deploy-1")
+				Expect(fields["error"]).To(Equal("Deploy 'deploy-1' did not set running_version to 'v1' within 50ms, rolled back"))
+			})
+		})
+	})
+
+	Describe("When the lease runs out while waiting for the service", func() {
+		BeforeEach(func() {
+			verification, _ := deployer.NewVerification("{{.EtcdDir}}/running_version", "{{.Tag}}", 50*time.Millisecond, false)
+			sut := deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{
+				Clock:         clock,
+				Verification:  verification,
+				LeaseDuration: 90 * time.Millisecond,
+			})
+			etcdClient.OnSet = func(key string) {
+				if key == "/octoblu/service-a/restart" {
+					clock.Advance(time.Hour)
+					queue.Recover()
+				}
+			}
+			err = sut.Run()
+		})
+
+		It("Should stop without reporting it", func() {
+			Expect(err).To(MatchError("Deploy 'deploy-1' is no longer in flight under this governator, its lease ran out"))
+			Expect(results).To(BeEmpty())
+		})
+
+		It("Should leave it to whoever claims it next", func() {
+			fields, _ := queue.InspectDeploy("deploy-1")
+			Expect(fields["status"]).To(Equal("pending"))
+		})
+	})
+
+	Describe("NewVerification", func() {
+		It("Should refuse an empty value", func() {
+			_, err := deployer.NewVerification("{{.EtcdDir}}/status", "", 0, false)
+			Expect(err).To(MatchError("Verification needs a value to wait for"))
+		})
+
+		It("Should refuse a template using unknown data", func() {
+			_, err := deployer.NewVerification("{{.EtcdDir}}/status", "{{.Health}}", 0, false)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const watchPingInterval = 5 * time.Second
+const watchRetryDelay = 1 * time.Second
+
+// Watch returns a channel that receives a value whenever a deploy is enqueued,
+// either announced on the <queue>:governator:enqueued channel or seen through
+// a keyspace notification on either deploys zset. Keyspace notifications need
+// notify-keyspace-events to include "Kz" on the redis server. Watch keeps
+// resubscribing after errors until done is closed
+func (queue *RedisQueue) Watch(done <-chan struct{}) <-chan bool {
+	wake := make(chan bool, 1)
+
+	go func() {
+		for {
+			err := queue.watch(wake, done)
+			select {
+			case <-done:
+				return
+			case <-time.After(watchRetryDelay):
+				debug("watch error: %v", err)
+			}
+		}
+	}()
+
+	return wake
+}
+
+func (queue *RedisQueue) watch(wake chan<- bool, done <-chan struct{}) error {
+	// subscribed connections are dialed directly, the pool
+	// cannot take them back while they are still receiving
+	redisConn, err := queue.redisPool.Dial()
+	if err != nil {
+		return err
+	}
+
+	pubSubConn := redis.PubSubConn{Conn: redisConn}
+	defer pubSubConn.Close()
+
+	err = pubSubConn.Subscribe(queue.getKey("governator:enqueued"))
+	if err != nil {
+		return err
+	}
+
+	err = pubSubConn.PSubscribe(
+		fmt.Sprintf("__keyspace@*__:%s", queue.getKey("governator:deploys")),
+		fmt.Sprintf("__keyspace@*__:%s", queue.getKey("governator:deploys:urgent")),
+	)
+	if err != nil {
+		return err
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			switch message := pubSubConn.Receive().(type) {
+			case redis.Message, redis.PMessage:
+				debug("watch: deploys changed")
+				select {
+				case wake <- true:
+				default:
+				}
+			case error:
+				received <- message
+				return
+			}
+		}
+	}()
+
+	// pings keep the read timeout from closing an idle subscription
+	pingTicker := time.NewTicker(watchPingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case err := <-received:
+			return err
+		case <-pingTicker.C:
+			err := pubSubConn.Ping("")
+			if err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
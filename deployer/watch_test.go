@@ -0,0 +1,149 @@
+package deployer_test
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+	var sut *deployer.Deployer
+	var queue *deployer.RedisQueue
+	var redisConn *redigomock.Conn
+
+	BeforeEach(func() {
+		redisConn = redigomock.NewConn()
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return redisConn, nil }}
+		queue = deployer.NewRedisQueue(redisPool, "redis-queue:name", nil)
+		sut = deployer.New(&FakeEtcdClient{}, queue, "https://deploy-state.test", "super", nil)
+	})
+
+	Describe("NextDeployIn", func() {
+		var wait time.Duration
+		var err error
+		var zrange, zrangeUrgent *redigomock.Cmd
+
+		BeforeEach(func() {
+			zrange = redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:deploys", "-inf", "+inf", "WITHSCORES", "LIMIT", 0, 1)
+			zrangeUrgent = redisConn.Command("ZRANGEBYSCORE", "redis-queue:name:governator:deploys:urgent", "-inf", "+inf", "WITHSCORES", "LIMIT", 0, 1)
+		})
+
+		Describe("When the queue is empty", func() {
+			BeforeEach(func() {
+				zrangeUrgent.Expect([]interface{}{})
+				zrange.Expect([]interface{}{})
+				wait, err = sut.NextDeployIn(10 * time.Second)
+			})
+
+			It("Should wait the maximum", func() {
+				Expect(err).To(BeNil())
+				Expect(wait).To(Equal(10 * time.Second))
+			})
+		})
+
+		Describe("When a deploy is overdue", func() {
+			BeforeEach(func() {
+				zrangeUrgent.Expect([]interface{}{})
+				score := strconv.FormatInt(time.Now().Add(-1*time.Minute).Unix(), 10)
+				zrange.Expect([]interface{}{[]byte("pending-deploy-1"), []byte(score)})
+				wait, err = sut.NextDeployIn(10 * time.Second)
+			})
+
+			It("Should not wait at all", func() {
+				Expect(err).To(BeNil())
+				Expect(wait).To(Equal(time.Duration(0)))
+			})
+		})
+
+		Describe("When a deploy is due soon", func() {
+			BeforeEach(func() {
+				zrangeUrgent.Expect([]interface{}{})
+				score := strconv.FormatInt(time.Now().Add(5*time.Second).Unix(), 10)
+				zrange.Expect([]interface{}{[]byte("pending-deploy-1"), []byte(score)})
+				wait, err = sut.NextDeployIn(10 * time.Second)
+			})
+
+			It("Should wait until it is due", func() {
+				Expect(err).To(BeNil())
+				Expect(wait).To(BeNumerically("~", 5*time.Second, 1*time.Second))
+			})
+		})
+
+		Describe("When an urgent deploy is due sooner", func() {
+			BeforeEach(func() {
+				score := strconv.FormatInt(time.Now().Add(1*time.Hour).Unix(), 10)
+				urgentScore := strconv.FormatInt(time.Now().Add(5*time.Second).Unix(), 10)
+				zrange.Expect([]interface{}{[]byte("pending-deploy-1"), []byte(score)})
+				zrangeUrgent.Expect([]interface{}{[]byte("urgent-deploy-1"), []byte(urgentScore)})
+				wait, err = sut.NextDeployIn(10 * time.Second)
+			})
+
+			It("Should wait until the urgent deploy is due", func() {
+				Expect(err).To(BeNil())
+				Expect(wait).To(BeNumerically("~", 5*time.Second, 1*time.Second))
+			})
+		})
+
+		Describe("When a deploy is due much later", func() {
+			BeforeEach(func() {
+				zrangeUrgent.Expect([]interface{}{})
+				score := strconv.FormatInt(time.Now().Add(1*time.Hour).Unix(), 10)
+				zrange.Expect([]interface{}{[]byte("pending-deploy-1"), []byte(score)})
+				wait, err = sut.NextDeployIn(10 * time.Second)
+			})
+
+			It("Should wait the maximum", func() {
+				Expect(err).To(BeNil())
+				Expect(wait).To(Equal(10 * time.Second))
+			})
+		})
+
+		Describe("When redis returns an error", func() {
+			BeforeEach(func() {
+				zrange.ExpectError(fmt.Errorf("oh no"))
+				wait, err = sut.NextDeployIn(10 * time.Second)
+			})
+
+			It("Should return the error", func() {
+				Expect(err).To(MatchError("oh no"))
+			})
+		})
+	})
+
+	Describe("Watch", func() {
+		var done chan struct{}
+		var wake <-chan bool
+
+		BeforeEach(func() {
+			done = make(chan struct{})
+			redisConn.Command("SUBSCRIBE", "redis-queue:name:governator:enqueued").Expect([]interface{}{
+				[]byte("subscribe"), []byte("redis-queue:name:governator:enqueued"), int64(1),
+			})
+			redisConn.Command("PSUBSCRIBE", "__keyspace@*__:redis-queue:name:governator:deploys", "__keyspace@*__:redis-queue:name:governator:deploys:urgent").Expect([]interface{}{
+				[]byte("psubscribe"), []byte("__keyspace@*__:redis-queue:name:governator:deploys"), int64(2),
+			})
+			redisConn.AddSubscriptionMessage([]interface{}{
+				[]byte("pmessage"),
+				[]byte("__keyspace@*__:redis-queue:name:governator:deploys"),
+				[]byte("__keyspace@0__:redis-queue:name:governator:deploys"),
+				[]byte("zadd"),
+			})
+			wake = queue.Watch(done)
+		})
+
+		AfterEach(func() {
+			close(done)
+		})
+
+		It("Should wake up on a keyspace notification", func() {
+			Eventually(wake).Should(Receive())
+		})
+	})
+})
@@ -0,0 +1,233 @@
+package deployer
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runWorkers claims every due deploy and deploys them with a bounded
+// number of workers. Deploys for the same etcdDir go to the same worker
+// in the order they were due
+func (deployer *Deployer) runWorkers() error {
+	claims, claimErr := deployer.claimDueDeploys()
+	groups, err := deployer.holdPausedGroups(groupByEtcdDir(claims))
+	if err == nil {
+		groups, err = deployer.holdUnscheduled(groups)
+	}
+	if err == nil && deployer.supersede {
+		groups, err = deployer.supersedeGroups(groups)
+	}
+	if err != nil {
+		if claimErr != nil {
+			log.Printf("could not claim every due deploy: %v", claimErr)
+		}
+		return deployer.releaseGroups(groups, err)
+	}
+
+	errs := make(chan error, len(groups))
+	slots := make(chan bool, deployer.workers)
+	var waitGroup sync.WaitGroup
+
+	for _, group := range groups {
+		waitGroup.Add(1)
+		slots <- true
+
+		go func(group []*Claim) {
+			defer waitGroup.Done()
+			errs <- deployer.deploySerially(group)
+			<-slots
+		}(group)
+	}
+
+	waitGroup.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return claimErr
+}
+
+// claimDueDeploys claims until nothing is due anymore, skipping
+// cancelled deploys. Whatever was claimed before an error is returned
+// along with it, those deploys are in flight already
+func (deployer *Deployer) claimDueDeploys() ([]*Claim, error) {
+	var claims []*Claim
+
+	for {
+		claim, err := deployer.queue.Claim()
+		if err != nil {
+			return claims, err
+		}
+
+		if claim == nil {
+			return claims, nil
+		}
+
+		if claim.Cancelled {
+			continue
+		}
+
+		claims = append(claims, claim)
+	}
+}
+
+// deploySerially deploys one etcdDir's deploys in order. When one fails it
+// is retried later, and the ones after it are requeued behind the retry.
+// One cancelled in flight is acked as cancelled and one the service never
+// reported healthy for as failed, without a retry, and the next one goes on.
+// The lease of each is renewed before it is looked at, since it waited for
+// the ones before it. One whose lease was lost stops the group, untouched.
+// Any other error stops it too, the deploys not started yet go back on
+// the queue then so they are not left in flight until their leases run out
+func (deployer *Deployer) deploySerially(group []*Claim) error {
+	for index, claim := range group {
+		err := deployer.queue.Renew(claim.Deploy)
+		if _, ok := err.(*lostLeaseError); ok {
+			return err
+		}
+		if err != nil {
+			return deployer.releaseGroups([][]*Claim{group[index:]}, err)
+		}
+
+		err = deployer.resolveRollback(claim)
+		if err != nil {
+			return deployer.failDeploys(group[index:], err)
+		}
+
+		// one that restarted the service already is live, it cannot expire
+		deadline := deployer.getDeadline(claim)
+		if !claim.Restarted && !deadline.IsZero() && deployer.clock.Now().After(deadline) {
+			err = deployer.expire(claim, deadline)
+			if err != nil {
+				return deployer.releaseGroups([][]*Claim{group[index:]}, err)
+			}
+			continue
+		}
+
+		reason, err := deployer.skipReason(claim)
+		if err != nil {
+			return deployer.failDeploys(group[index:], err)
+		}
+
+		if reason != "" {
+			log.Printf("skipping deploy %v: %v", claim.Deploy, reason)
+			err = deployer.ack(claim.Deploy, StatusSkipped, "skipped:reason", reason)
+			if err != nil {
+				return deployer.releaseGroups([][]*Claim{group[index:]}, err)
+			}
+			continue
+		}
+
+		err = deployer.queue.Start(claim.Deploy)
+		if _, ok := err.(*lostLeaseError); ok {
+			return err
+		}
+		if err != nil {
+			return deployer.releaseGroups([][]*Claim{group[index:]}, err)
+		}
+
+		err = deployer.deploy(claim)
+		if cancelled, ok := err.(*cancelledError); ok {
+			log.Println(cancelled)
+			err = deployer.ack(claim.Deploy, StatusCancelled, "cancelled:after", cancelled.after)
+			if err != nil {
+				return deployer.releaseGroups([][]*Claim{group[index+1:]}, err)
+			}
+			continue
+		}
+		if _, ok := err.(*lostLeaseError); ok {
+			return err
+		}
+		if unverified, ok := err.(*unverifiedError); ok {
+			log.Println(unverified)
+			err = deployer.ack(claim.Deploy, StatusFailed, "error", unverified.Error())
+			if err != nil {
+				return deployer.releaseGroups([][]*Claim{group[index+1:]}, err)
+			}
+			continue
+		}
+		if err != nil {
+			return deployer.failDeploys(group[index:], err)
+		}
+
+		err = deployer.ack(claim.Deploy, StatusDone)
+		if err != nil {
+			return deployer.releaseGroups([][]*Claim{group[index+1:]}, err)
+		}
+	}
+	return nil
+}
+
+// releaseGroups puts claimed deploys that cannot go out because of the
+// cause back on the queue, due when they were due, without counting an
+// attempt. It returns the cause. The steps that hold back claimed groups
+// before they go out return the groups still in flight along with their
+// error, for runWorkers to release here
+func (deployer *Deployer) releaseGroups(groups [][]*Claim, cause error) error {
+	for _, group := range groups {
+		for _, claim := range group {
+			dueAt := claim.DueAt
+			if dueAt.IsZero() {
+				dueAt = deployer.clock.Now()
+			}
+
+			err := deployer.queue.Requeue(claim.Deploy, dueAt)
+			if err != nil {
+				log.Printf("could not put %v back on the queue: %v", claim.Deploy, err)
+			}
+		}
+	}
+	return cause
+}
+
+// failDeploys fails the first deploy of the group and requeues
+// the rest of the group behind its retry
+func (deployer *Deployer) failDeploys(group []*Claim, cause error) error {
+	retryAt, err := deployer.fail(group[0].Deploy, cause)
+	if err != nil {
+		return err
+	}
+	return deployer.requeueDeploys(group[1:], retryAt)
+}
+
+// requeueDeploys puts claimed deploys back on the queue without counting an
+// attempt, one second apart from dueAt on so they keep their order
+func (deployer *Deployer) requeueDeploys(claims []*Claim, dueAt time.Time) error {
+	for index, claim := range claims {
+		err := deployer.queue.Requeue(claim.Deploy, dueAt.Add(time.Duration(index+1)*time.Second))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupByEtcdDir groups the claims per etcdDir, each group in the order the
+// deploys were due. Urgent deploys are claimed first, so that is not
+// necessarily the order they were claimed in
+func groupByEtcdDir(claims []*Claim) [][]*Claim {
+	var groups [][]*Claim
+	indexes := make(map[string]int)
+
+	for _, claim := range claims {
+		index, ok := indexes[claim.Metadata.EtcdDir]
+		if !ok {
+			index = len(groups)
+			indexes[claim.Metadata.EtcdDir] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], claim)
+	}
+
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].DueAt.Before(group[j].DueAt)
+		})
+	}
+	return groups
+}
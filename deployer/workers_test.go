@@ -0,0 +1,186 @@
+package deployer_test
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/jarcoal/httpmock"
+	"github.com/octoblu/governator/deployer"
+	"github.com/rafaeljusto/redigomock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Workers", func() {
+	var sut *deployer.Deployer
+	var redisConn *redigomock.Conn
+	var etcdClient *FakeEtcdClient
+	var err error
+
+	BeforeEach(func() {
+		httpmock.Activate()
+		redisConn = redigomock.NewConn()
+		redisConn.GenericCommand("EXPIRE")
+		redisConn.GenericCommand("GET")
+		redisConn.GenericCommand("SET")
+		noReleases(redisConn)
+		redisConn.GenericCommand("HSET")
+		redisConn.GenericCommand("HGET")
+		lockedConn := &LockedConn{Conn: redisConn}
+		redisPool := &redis.Pool{Dial: func() (redis.Conn, error) { return lockedConn, nil }}
+		etcdClient = &FakeEtcdClient{}
+		queue := deployer.NewRedisQueue(redisPool, "redis-queue:name", &deployer.QueueOptions{InstanceID: "governator-1"})
+		sut = deployer.New(etcdClient, queue, "https://deploy-state.test", "super", &deployer.Options{
+			Workers: 4,
+		})
+
+		redisConn.GenericCommand("EVALSHA").
+			Expect(claimedReply("deploy-1", "/octoblu/service-a", "octoblu/service-a:v1")).
+			Expect(claimedReply("deploy-2", "/octoblu/service-b", "octoblu/service-b:v1")).
+			Expect([]interface{}{[]byte("deploy-3"), []byte("cancelled")}).
+			Expect(claimedReply("deploy-4", "/octoblu/service-a", "octoblu/service-a:v2")).
+			Expect(nil)
+		redisConn.GenericCommand("ZADD").Expect(int64(0))
+		for _, deploy := range []string{"deploy-1", "deploy-2", "deploy-4"} {
+			renewedLease(redisConn, deploy)
+		}
+		redisConn.GenericCommand("ZREM").Expect(int64(1))
+		cancellation := redisConn.GenericCommand("HEXISTS")
+		for check := 0; check < 12; check++ {
+			cancellation.Expect(int64(0))
+		}
+		redisConn.GenericCommand("HMSET")
+
+		rsp := httpmock.NewStringResponder(200, "Ok")
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v1/cluster/super/passed", rsp)
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-a/v2/cluster/super/passed", rsp)
+		httpmock.RegisterResponder("PUT", "https://deploy-state.test/deployments/octoblu/service-b/v1/cluster/super/passed", rsp)
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	Describe("When several deploys are due", func() {
+		BeforeEach(func() {
+			err = sut.Run()
+		})
+
+		It("Should not error", func() {
+			Expect(err).To(BeNil())
+		})
+
+		It("Should deploy every claimed deploy in one run", func() {
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-b")).To(Equal([]string{"octoblu/service-b:v1"}))
+		})
+
+		It("Should deploy the same service serially in score order", func() {
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-a")).To(Equal([]string{"octoblu/service-a:v1", "octoblu/service-a:v2"}))
+		})
+	})
+
+	Describe("When the pause of a service cannot be read", func() {
+		var requeues []*redigomock.Cmd
+
+		BeforeEach(func() {
+			redisConn.Command("GET", "redis-queue:name:governator:paused:/octoblu/service-b").ExpectError(fmt.Errorf("redis is gone"))
+			requeues = []*redigomock.Cmd{
+				redisConn.Command("ZADD", "redis-queue:name:governator:deploys", int64(1000), "deploy-1").Expect(int64(1)),
+				redisConn.Command("ZADD", "redis-queue:name:governator:deploys", int64(1000), "deploy-2").Expect(int64(1)),
+				redisConn.Command("ZADD", "redis-queue:name:governator:deploys", int64(1000), "deploy-4").Expect(int64(1)),
+			}
+			err = sut.Run()
+		})
+
+		It("Should return the error", func() {
+			Expect(err).To(MatchError("redis is gone"))
+		})
+
+		It("Should put every claimed deploy back on the queue", func() {
+			for _, requeue := range requeues {
+				Expect(redisConn.Stats(requeue)).To(Equal(1))
+			}
+		})
+
+		It("Should not deploy anything", func() {
+			Expect(etcdClient.SetCalls).To(BeEmpty())
+		})
+	})
+
+	Describe("When a deploy of a service cannot be acked", func() {
+		var requeue *redigomock.Cmd
+
+		BeforeEach(func() {
+			redisConn.Command("ZREM", "redis-queue:name:governator:inflight", "deploy-1").ExpectError(fmt.Errorf("redis is gone"))
+			requeue = redisConn.Command("ZADD", "redis-queue:name:governator:deploys", int64(1000), "deploy-4").Expect(int64(1))
+			err = sut.Run()
+		})
+
+		It("Should return the error", func() {
+			Expect(err).To(MatchError("redis is gone"))
+		})
+
+		It("Should put the newer version of the service back on the queue", func() {
+			Expect(redisConn.Stats(requeue)).To(Equal(1), "ZADD was not called for deploy-4")
+		})
+
+		It("Should not deploy the newer version of the service", func() {
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-a")).To(Equal([]string{"octoblu/service-a:v1"}))
+		})
+	})
+
+	Describe("When a deploy of a service fails", func() {
+		var requeue *redigomock.Cmd
+
+		BeforeEach(func() {
+			redisConn.GenericCommand("HINCRBY").Expect(int64(1)).Expect(int64(1))
+			requeue = redisConn.Command("ZADD", "redis-queue:name:governator:deploys", redigomock.NewAnyInt(), "deploy-4").Expect(int64(1))
+			etcdClient.SetError = fmt.Errorf("etcd is gone")
+			err = sut.Run()
+		})
+
+		It("Should not error", func() {
+			Expect(err).To(BeNil())
+		})
+
+		It("Should requeue the newer version of the service behind the retry", func() {
+			Expect(redisConn.Stats(requeue)).To(Equal(1), "ZADD was not called for deploy-4")
+		})
+
+		It("Should not deploy the newer version of the service", func() {
+			Expect(dockerURLsFor(etcdClient, "/octoblu/service-a")).To(Equal([]string{"octoblu/service-a:v1"}))
+		})
+	})
+})
+
+func claimedReply(deploy, etcdDir, dockerURL string) []interface{} {
+	metadata := fmt.Sprintf(`{"etcdDir":"%s","dockerUrl":"%s"}`, etcdDir, dockerURL)
+	return []interface{}{[]byte(deploy), []byte("claimed"), []byte(metadata), []byte("1000"), []byte("")}
+}
+
+func dockerURLsFor(etcdClient *FakeEtcdClient, etcdDir string) []string {
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+
+	var dockerURLs []string
+	for _, call := range etcdClient.SetCalls {
+		if call[0] == etcdDir+"/docker_url" {
+			dockerURLs = append(dockerURLs, call[1])
+		}
+	}
+	return dockerURLs
+}
+
+// LockedConn lets several workers share one redigomock connection
+type LockedConn struct {
+	*redigomock.Conn
+	mutex sync.Mutex
+}
+
+func (conn *LockedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.Conn.Do(commandName, args...)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+)
+
+func gcCommand() cli.Command {
+	return cli.Command{
+		Name:   "gc",
+		Usage:  "Remove the hashes of finished deploys that no zset refers to and redis will not expire",
+		Action: collectGarbage,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only list the hashes that would be removed",
+			},
+		},
+	}
+}
+
+func collectGarbage(context *cli.Context) error {
+	queue := getRedisQueue(context)
+	orphans, err := queue.Orphans()
+	if err != nil {
+		return err
+	}
+
+	if context.Bool("dry-run") {
+		for _, deploy := range orphans {
+			fmt.Printf("would remove %s\n", deploy)
+		}
+		return nil
+	}
+
+	for _, deploy := range orphans {
+		removed, err := queue.RemoveOrphan(deploy)
+		if err != nil {
+			return err
+		}
+
+		if removed {
+			fmt.Printf("removed %s\n", deploy)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/octoblu/governator/deployer"
+	"gopkg.in/yaml.v2"
+)
+
+// keyLayoutsConfig is the file given to --key-layouts, like
+//
+//	layouts:
+//	  plain:
+//	    - key: "{{.EtcdDir}}/image"
+//	      value: "{{.DockerURL}}"
+//	    - key: "{{.EtcdDir}}/deployed-by"
+//	      value: "{{.Deploy}} on {{.Cluster}}"
+//	    - key: "{{.EtcdDir}}/restart"
+//	      value: "{{.Time.Unix}}"
+//	etcdDirs:
+//	  /octoblu/new-service: plain
+//
+// A layout named default replaces the default layout. The templates can
+// use EtcdDir, DockerURL, Image, Tag, Deploy, Cluster and Time
+type keyLayoutsConfig struct {
+	Layouts  map[string][]keyTemplateConfig `yaml:"layouts"`
+	EtcdDirs map[string]string              `yaml:"etcdDirs"`
+}
+
+type keyTemplateConfig struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+// loadKeyLayouts reads the keys written per deploy
+func loadKeyLayouts(keyLayoutsPath string) (*deployer.KeyLayouts, error) {
+	keyLayoutsBytes, err := ioutil.ReadFile(keyLayoutsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var theConfig keyLayoutsConfig
+	err = yaml.Unmarshal(keyLayoutsBytes, &theConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	layouts := make(map[string]*deployer.KeyLayout, len(theConfig.Layouts))
+	for name, keys := range theConfig.Layouts {
+		var templates []deployer.KeyTemplate
+		for _, key := range keys {
+			templates = append(templates, deployer.KeyTemplate{Key: key.Key, Value: key.Value})
+		}
+
+		layouts[name], err = deployer.NewKeyLayout(templates)
+		if err != nil {
+			return nil, fmt.Errorf("layout %v: %v", name, err)
+		}
+	}
+
+	keyLayouts := &deployer.KeyLayouts{
+		Default:  layouts["default"],
+		EtcdDirs: make(map[string]*deployer.KeyLayout, len(theConfig.EtcdDirs)),
+	}
+	for etcdDir, name := range theConfig.EtcdDirs {
+		layout, ok := layouts[name]
+		if !ok {
+			return nil, fmt.Errorf("etcdDir %v uses layout %v, which is not defined", etcdDir, name)
+		}
+		keyLayouts.EtcdDirs[etcdDir] = layout
+	}
+	return keyLayouts, nil
+}
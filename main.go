@@ -1,10 +1,13 @@
 package main
 
 import (
+	_ "expvar"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,19 +15,37 @@ import (
 	"github.com/coreos/go-semver/semver"
 	"github.com/fatih/color"
 	"github.com/garyburd/redigo/redis"
-	"github.com/octoblu/go-simple-etcd-client/etcdclient"
 	"github.com/octoblu/governator/deployer"
+	"github.com/octoblu/governator/redispool"
 	De "github.com/tj/go-debug"
 )
 
 var debug = De.Debug("governator:main")
 
+const (
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "governator"
 	app.Version = version()
 	app.Action = run
+	app.Commands = []cli.Command{
+		deadLetterCommand(),
+		gcCommand(),
+		pauseCommand(),
+		resumeCommand(),
+		rollbackCommand(),
+		releasesCommand(),
+	}
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config, c",
+			EnvVar: "GOVERNATOR_CONFIG",
+			Usage:  "YAML file listing several queues to deploy from, each with its redisQueue, cluster, etcdUri, deployStateUri and optional redisUri",
+		},
 		cli.StringFlag{
 			Name:   "etcd-uri, e",
 			EnvVar: "GOVERNATOR_ETCD_URI",
@@ -33,7 +54,7 @@ func main() {
 		cli.StringFlag{
 			Name:   "redis-uri, r",
 			EnvVar: "GOVERNATOR_REDIS_URI",
-			Usage:  "Redis server to pull deployments from",
+			Usage:  "Redis server to pull deployments from, redis-sentinel://[:password@]host:port[,host:port]/master-name[/db] follows a sentinel master",
 		},
 		cli.StringFlag{
 			Name:   "redis-queue, q",
@@ -50,40 +71,295 @@ func main() {
 			EnvVar: "CLUSTER",
 			Usage:  "The current running cluster",
 		},
+		cli.StringFlag{
+			Name:   "instance-id",
+			EnvVar: "GOVERNATOR_INSTANCE_ID",
+			Usage:  "Identifies this instance as the owner of claimed deploys, defaults to hostname:pid",
+		},
+		cli.DurationFlag{
+			Name:   "lease-duration",
+			EnvVar: "GOVERNATOR_LEASE_DURATION",
+			Usage:  "How long a claimed deploy may stay in flight before it is recovered",
+			Value:  deployer.DefaultLeaseDuration,
+		},
+		cli.IntFlag{
+			Name:   "workers",
+			EnvVar: "GOVERNATOR_WORKERS",
+			Usage:  "How many services to deploy in parallel, above 1 every due deploy is claimed at once",
+			Value:  1,
+		},
+		cli.BoolFlag{
+			Name:   "supersede",
+			EnvVar: "GOVERNATOR_SUPERSEDE",
+			Usage:  "Only deploy the newest due deploy per etcdDir, marking the older ones superseded",
+		},
+		cli.IntFlag{
+			Name:   "max-attempts",
+			EnvVar: "GOVERNATOR_MAX_ATTEMPTS",
+			Usage:  "How many times a failing deploy is tried before it is dead lettered",
+			Value:  deployer.DefaultMaxAttempts,
+		},
+		cli.DurationFlag{
+			Name:   "retry-backoff",
+			EnvVar: "GOVERNATOR_RETRY_BACKOFF",
+			Usage:  "Delay before the first retry of a failed deploy, doubled on every attempt",
+			Value:  deployer.DefaultRetryBackoff,
+		},
+		cli.StringFlag{
+			Name:   "queue-backend",
+			EnvVar: "GOVERNATOR_QUEUE_BACKEND",
+			Usage:  "zset to claim deploys straight from the zsets, streams to share them through a redis stream consumer group (needs redis 6.2)",
+			Value:  "zset",
+		},
+		cli.BoolFlag{
+			Name:   "redis-cluster",
+			EnvVar: "GOVERNATOR_REDIS_CLUSTER",
+			Usage:  "Redis Cluster mode, every key gets the {queue} hash tag and governator connects to the node serving it",
+		},
+		cli.BoolFlag{
+			Name:   "redis-time",
+			EnvVar: "GOVERNATOR_REDIS_TIME",
+			Usage:  "Decide which deploys are due with the redis TIME instead of the local clock",
+		},
+		cli.DurationFlag{
+			Name:   "clock-skew-warning",
+			EnvVar: "GOVERNATOR_CLOCK_SKEW_WARNING",
+			Usage:  "Warn when local and redis time differ by more than this, with --redis-time",
+			Value:  deployer.DefaultClockSkewWarning,
+		},
+		cli.StringFlag{
+			Name:   "metrics-address",
+			EnvVar: "GOVERNATOR_METRICS_ADDRESS",
+			Usage:  "Serve metrics on http://<address>/debug/vars, like :9102",
+		},
+		cli.StringFlag{
+			Name:   "schedule",
+			EnvVar: "GOVERNATOR_SCHEDULE",
+			Usage:  "YAML file with the allowed deploy windows as cron expressions, blackouts and their timeZone. Deploys outside of it wait unless they are emergencies",
+		},
+		cli.StringFlag{
+			Name:   "key-layouts",
+			EnvVar: "GOVERNATOR_KEY_LAYOUTS",
+			Usage:  "YAML file with templated sets of etcd keys written per deploy and the etcdDirs using them, instead of docker_url, env/SENTRY_RELEASE and restart",
+		},
+		cli.StringFlag{
+			Name:   "verify-key",
+			EnvVar: "GOVERNATOR_VERIFY_KEY",
+			Usage:  "Key the service sets once it runs healthy, like {{.EtcdDir}}/running_version. Deploys are only reported passed once it holds --verify-value",
+		},
+		cli.StringFlag{
+			Name:   "verify-value",
+			EnvVar: "GOVERNATOR_VERIFY_VALUE",
+			Usage:  "Value --verify-key has to be set to, like {{.Tag}} or healthy",
+		},
+		cli.DurationFlag{
+			Name:   "verify-timeout",
+			EnvVar: "GOVERNATOR_VERIFY_TIMEOUT",
+			Usage:  "How long the service gets to set --verify-key, later the deploy is reported failed",
+			Value:  deployer.DefaultVerifyTimeout,
+		},
+		cli.BoolFlag{
+			Name:   "verify-rollback",
+			EnvVar: "GOVERNATOR_VERIFY_ROLLBACK",
+			Usage:  "Put the keys of a deploy that was not verified back the way they were",
+		},
+		cli.DurationFlag{
+			Name:   "max-lateness",
+			EnvVar: "GOVERNATOR_MAX_LATENESS",
+			Usage:  "How long after it was due a deploy is still rolled out, later it expires and is reported failed. 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:   "deploy-ttl",
+			EnvVar: "GOVERNATOR_DEPLOY_TTL",
+			Usage:  "How long the hash of a finished deploy is kept in redis before it expires",
+			Value:  deployer.DefaultDeployTTL,
+		},
+		cli.DurationFlag{
+			Name:   "max-normal-delay",
+			EnvVar: "GOVERNATOR_MAX_NORMAL_DELAY",
+			Usage:  "How long a due deploy may wait behind urgent ones from governator:deploys:urgent before it goes first",
+			Value:  deployer.DefaultMaxNormalDelay,
+		},
+		cli.DurationFlag{
+			Name:   "max-wait",
+			EnvVar: "GOVERNATOR_MAX_WAIT",
+			Usage:  "Longest time to sleep between checks when no enqueue notification arrives",
+			Value:  10 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:   "lease-recovery-interval",
+			EnvVar: "GOVERNATOR_LEASE_RECOVERY_INTERVAL",
+			Usage:  "How often to look for in flight deploys with an expired lease",
+			Value:  30 * time.Second,
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		color.Red("  %v", err)
+		os.Exit(1)
 	}
-	app.Run(os.Args)
 }
 
 func run(context *cli.Context) {
-	etcdURI, redisURI, redisQueue, deployStateUri, cluster := getOpts(context)
+	queueBackend := context.String("queue-backend")
+	if queueBackend != "zset" && queueBackend != "streams" {
+		color.Red("  Invalid --queue-backend '%v', use zset or streams", queueBackend)
+		os.Exit(1)
+	}
 
-	etcdClient := getEtcdClient(etcdURI)
-	redisConn := getRedisConn(redisURI)
+	queueConfigs := getQueueConfigs(context)
+	deployerOptions := getDeployerOptions(context)
+	serveMetrics(context.String("metrics-address"))
 
-	theDeployer := deployer.New(etcdClient, redisConn, redisQueue, deployStateUri, cluster)
-	sigTerm := make(chan os.Signal)
+	sigTerm := make(chan os.Signal, 1)
 	signal.Notify(sigTerm, syscall.SIGTERM)
 
-	sigTermReceived := false
+	stopping := make(chan struct{})
 
 	go func() {
 		<-sigTerm
 		fmt.Println("SIGTERM received, waiting to exit")
-		sigTermReceived = true
+		close(stopping)
 	}()
 
-	for {
-		if sigTermReceived {
-			fmt.Println("I'll be back.")
-			os.Exit(0)
-		}
+	redisPools := make(map[string]*redis.Pool)
+	clocks := make(map[*redis.Pool]deployer.Clock)
+	var runners []*queueRunner
 
-		debug("theDeployer.Run()")
-		err := theDeployer.Run()
-		if err != nil {
-			log.Panic("Run error", err)
-		}
-		time.Sleep(1 * time.Second)
+	for _, queueConfig := range queueConfigs {
+		runners = append(runners, getQueueRunner(context, queueConfig, deployerOptions, redisPools, clocks))
+	}
+	publishQueueStatuses(runners)
+
+	var waitGroup sync.WaitGroup
+	for _, runner := range runners {
+		waitGroup.Add(1)
+		go func(runner *queueRunner) {
+			defer waitGroup.Done()
+			runner.run(stopping)
+		}(runner)
+	}
+	waitGroup.Wait()
+
+	fmt.Println("I'll be back.")
+	os.Exit(0)
+}
+
+// getQueue builds the queue of the chosen backend, the zsets and hashes
+// governator-service writes to or a redis stream fed from those zsets
+func getQueue(queueBackend string, redisPool *redis.Pool, redisQueue string, options *deployer.QueueOptions) watchedQueue {
+	if queueBackend == "streams" {
+		return deployer.NewStreamQueue(redisPool, redisQueue, options)
+	}
+	return deployer.NewRedisQueue(redisPool, redisQueue, options)
+}
+
+func getSchedule(context *cli.Context) *deployer.Schedule {
+	schedulePath := context.String("schedule")
+	if schedulePath == "" {
+		return nil
+	}
+
+	schedule, err := loadSchedule(schedulePath)
+	if err != nil {
+		color.Red("  Invalid --schedule %v: %v", schedulePath, err)
+		os.Exit(1)
+	}
+	return schedule
+}
+
+func getKeyLayouts(context *cli.Context) *deployer.KeyLayouts {
+	keyLayoutsPath := context.String("key-layouts")
+	if keyLayoutsPath == "" {
+		return nil
+	}
+
+	keyLayouts, err := loadKeyLayouts(keyLayoutsPath)
+	if err != nil {
+		color.Red("  Invalid --key-layouts %v: %v", keyLayoutsPath, err)
+		os.Exit(1)
+	}
+	return keyLayouts
+}
+
+func getVerification(context *cli.Context) *deployer.Verification {
+	verifyKey := context.String("verify-key")
+	if verifyKey == "" {
+		return nil
+	}
+
+	verifyValue := context.String("verify-value")
+	if verifyValue == "" {
+		color.Red("  Missing required flag --verify-value or GOVERNATOR_VERIFY_VALUE, needed with --verify-key")
+		os.Exit(1)
+	}
+
+	verifyTimeout := context.Duration("verify-timeout")
+	if verifyTimeout >= context.Duration("lease-duration") {
+		color.Red("  --verify-timeout has to be shorter than --lease-duration, or another governator may take over the deploy")
+		os.Exit(1)
+	}
+
+	verification, err := deployer.NewVerification(verifyKey, verifyValue, verifyTimeout, context.Bool("verify-rollback"))
+	if err != nil {
+		color.Red("  Invalid --verify-key or --verify-value: %v", err)
+		os.Exit(1)
+	}
+	return verification
+}
+
+func getQueueConfigs(context *cli.Context) []queueConfig {
+	configPath := context.String("config")
+	if configPath == "" {
+		etcdURI, redisURI, redisQueue, deployStateUri, cluster := getOpts(context)
+		return []queueConfig{{
+			Name:           redisQueue,
+			RedisURI:       redisURI,
+			RedisQueue:     redisQueue,
+			Cluster:        cluster,
+			EtcdURI:        etcdURI,
+			DeployStateUri: deployStateUri,
+		}}
+	}
+
+	queueConfigs, err := loadQueueConfigs(configPath, context.String("redis-uri"))
+	if err != nil {
+		color.Red("  %v", err)
+		os.Exit(1)
+	}
+	return queueConfigs
+}
+
+// getQueueRunner builds the deployer of a queue, queues on the same
+// redis server share a pool and a clock
+func getQueueRunner(context *cli.Context, queueConfig queueConfig, deployerOptions deployer.Options, redisPools map[string]*redis.Pool, clocks map[*redis.Pool]deployer.Clock) *queueRunner {
+	redisCluster := context.Bool("redis-cluster")
+	poolKey := queueConfig.RedisURI
+	if redisCluster {
+		poolKey = fmt.Sprintf("%s %s", queueConfig.RedisURI, queueConfig.RedisQueue)
+	}
+
+	redisPool, ok := redisPools[poolKey]
+	if !ok {
+		redisPool = getRedisPool(queueConfig.RedisURI, queueConfig.RedisQueue, redisCluster)
+		redisPools[poolKey] = redisPool
+		clocks[redisPool] = getClock(context, redisPool)
+	}
+	clock := clocks[redisPool]
+
+	etcdClient := getEtcdClient(queueConfig.EtcdURI)
+	queue := getQueue(context.String("queue-backend"), redisPool, queueConfig.RedisQueue, getQueueOptions(context, clock))
+	deployerOptions.Clock = clock
+	theDeployer := deployer.New(etcdClient, queue, queueConfig.DeployStateUri, queueConfig.Cluster, &deployerOptions)
+
+	return &queueRunner{
+		name:             queueConfig.Name,
+		cluster:          queueConfig.Cluster,
+		deployer:         theDeployer,
+		queue:            queue,
+		clock:            clock,
+		maxWait:          context.Duration("max-wait"),
+		recoveryInterval: context.Duration("lease-recovery-interval"),
 	}
 }
 
@@ -118,20 +394,81 @@ func getOpts(context *cli.Context) (string, string, string, string, string) {
 	return etcdURI, redisURI, redisQueue, deployStateUri, cluster
 }
 
-func getEtcdClient(etcdURI string) etcdclient.EtcdClient {
-	etcdClient, err := etcdclient.Dial(etcdURI)
+func getQueueOptions(context *cli.Context, clock deployer.Clock) *deployer.QueueOptions {
+	return &deployer.QueueOptions{
+		Clock:          clock,
+		InstanceID:     context.String("instance-id"),
+		LeaseDuration:  context.Duration("lease-duration"),
+		MaxAttempts:    context.Int("max-attempts"),
+		RetryBackoff:   context.Duration("retry-backoff"),
+		MaxNormalDelay: context.Duration("max-normal-delay"),
+		DeployTTL:      context.Duration("deploy-ttl"),
+		HashTag:        context.Bool("redis-cluster"),
+	}
+}
+
+// getDeployerOptions reads the options every deployer shares,
+// the clock depends on the redis server of the queue
+func getDeployerOptions(context *cli.Context) deployer.Options {
+	return deployer.Options{
+		Workers:       context.Int("workers"),
+		Supersede:     context.Bool("supersede"),
+		MaxLateness:   context.Duration("max-lateness"),
+		Schedule:      getSchedule(context),
+		KeyLayouts:    getKeyLayouts(context),
+		Verification:  getVerification(context),
+		LeaseDuration: context.Duration("lease-duration"),
+	}
+}
+
+func getClock(context *cli.Context, redisPool *redis.Pool) deployer.Clock {
+	if !context.Bool("redis-time") {
+		return deployer.SystemClock{}
+	}
+
+	return deployer.NewRedisClock(redisPool, &deployer.RedisClockOptions{
+		SkewWarning: context.Duration("clock-skew-warning"),
+	})
+}
+
+func serveMetrics(metricsAddress string) {
+	if metricsAddress == "" {
+		return
+	}
+
+	go func() {
+		err := http.ListenAndServe(metricsAddress, nil)
+		log.Println("Metrics server error", err)
+	}()
+}
+
+func nextRetryDelay(retryDelay time.Duration) time.Duration {
+	retryDelay *= 2
+	if retryDelay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return retryDelay
+}
+
+func getEtcdClient(etcdURI string) deployer.EtcdClient {
+	etcdClient, err := deployer.DialEtcd(etcdURI)
 	if err != nil {
-		log.Panicln("Error with etcdclient.New", err.Error())
+		log.Panicln("Error with deployer.DialEtcd", err.Error())
 	}
 	return etcdClient
 }
 
-func getRedisConn(redisURI string) redis.Conn {
-	redisConn, err := redis.DialURL(redisURI)
+func getRedisPool(redisURI, redisQueue string, redisCluster bool) *redis.Pool {
+	options := &redispool.Options{}
+	if redisCluster {
+		options.ClusterKey = deployer.ClusterHashTag(redisQueue)
+	}
+
+	redisPool, err := redispool.New(redisURI, options)
 	if err != nil {
-		log.Panicln("Error with redis.DialURL", err.Error())
+		log.Panicln("Error with redispool.New", err.Error())
 	}
-	return redisConn
+	return redisPool
 }
 
 func version() string {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+)
+
+func pauseCommand() cli.Command {
+	return cli.Command{
+		Name:   "pause",
+		Usage:  "Stop claiming deploys, for the whole queue or one etcdDir, they stay queued",
+		Action: pauseDeploys,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "etcd-dir",
+				Usage: "Only pause the deploys to this etcdDir",
+			},
+			cli.StringFlag{
+				Name:  "reason",
+				Usage: "Why deploys are paused, shown in the logs and metrics",
+			},
+			cli.DurationFlag{
+				Name:  "ttl",
+				Usage: "Resume by itself after this long, 0 to stay paused until resumed",
+			},
+		},
+	}
+}
+
+func resumeCommand() cli.Command {
+	return cli.Command{
+		Name:   "resume",
+		Usage:  "Resume deploys paused with pause",
+		Action: resumeDeploys,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "etcd-dir",
+				Usage: "Resume the deploys to this etcdDir, paused on their own",
+			},
+		},
+	}
+}
+
+func pauseDeploys(context *cli.Context) error {
+	etcdDir := context.String("etcd-dir")
+	err := getRedisQueue(context).Pause(etcdDir, context.String("reason"), context.Duration("ttl"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("paused %s\n", describePauseTarget(context, etcdDir))
+	return nil
+}
+
+func resumeDeploys(context *cli.Context) error {
+	etcdDir := context.String("etcd-dir")
+	resumed, err := getRedisQueue(context).Resume(etcdDir)
+	if err != nil {
+		return err
+	}
+
+	if !resumed {
+		fmt.Printf("%s was not paused\n", describePauseTarget(context, etcdDir))
+		return nil
+	}
+
+	fmt.Printf("resumed %s\n", describePauseTarget(context, etcdDir))
+	return nil
+}
+
+func describePauseTarget(context *cli.Context, etcdDir string) string {
+	if etcdDir == "" {
+		return context.GlobalString("redis-queue")
+	}
+	return fmt.Sprintf("%s %s", context.GlobalString("redis-queue"), etcdDir)
+}
@@ -0,0 +1,181 @@
+// Package redispool builds the redis connection pools governator takes
+// deploys from. Besides redis:// uris it follows the master of a redis
+// sentinel setup and the node serving the queue's slot in a redis cluster
+package redispool
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	De "github.com/tj/go-debug"
+)
+
+var debug = De.Debug("governator:redispool")
+
+const (
+	dialTimeout  = 5 * time.Second
+	readTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// Options are the optional settings of a pool
+type Options struct {
+	// ClusterKey makes the pool connect to the redis cluster node serving
+	// the slot of this key, whichever node of the cluster the uri names
+	ClusterKey string
+}
+
+type dialFunc func() (redis.Conn, error)
+
+// New constructs a pool for a redis:// uri or for a sentinel uri like
+// redis-sentinel://[:password@]host:port[,host:port...]/master-name[/db],
+// options may be nil
+func New(redisURI string, options *Options) (*redis.Pool, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	var dial dialFunc
+	isSentinel := isSentinelURI(redisURI)
+
+	if isSentinel {
+		if options.ClusterKey != "" {
+			return nil, fmt.Errorf("redis-sentinel:// uris cannot be used with a redis cluster")
+		}
+
+		sentinel, err := parseSentinelURI(redisURI)
+		if err != nil {
+			return nil, err
+		}
+		dial = sentinel.dialMaster
+	} else {
+		seed, err := url.Parse(redisURI)
+		if err != nil {
+			return nil, err
+		}
+
+		dial = func() (redis.Conn, error) {
+			return redis.DialURL(redisURI, dialOptions()...)
+		}
+
+		if options.ClusterKey != "" {
+			dial = clusterNodeDial(seed, options.ClusterKey, dial)
+		}
+	}
+
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+		Dial:        dial,
+		TestOnBorrow: func(redisConn redis.Conn, lastUsed time.Time) error {
+			// after a failover the old master comes back as a replica,
+			// its connections have to go so the pool dials the new one
+			if isSentinel {
+				return checkMaster(redisConn)
+			}
+
+			if time.Since(lastUsed) < time.Minute {
+				return nil
+			}
+			_, err := redisConn.Do("PING")
+			return err
+		},
+	}, nil
+}
+
+// clusterNodeDial asks the node of the uri which node serves the key's slot
+// and connects to that one instead
+func clusterNodeDial(seed *url.URL, key string, dialSeed dialFunc) dialFunc {
+	return func() (redis.Conn, error) {
+		seedConn, err := dialSeed()
+		if err != nil {
+			return nil, err
+		}
+		defer seedConn.Close()
+
+		slot, err := redis.Int(seedConn.Do("CLUSTER", "KEYSLOT", key))
+		if err != nil {
+			return nil, err
+		}
+
+		ranges, err := redis.Values(seedConn.Do("CLUSTER", "SLOTS"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, slotRange := range ranges {
+			values, err := redis.Values(slotRange, nil)
+			if err != nil || len(values) < 3 {
+				return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply: %v", slotRange)
+			}
+
+			start, _ := redis.Int(values[0], nil)
+			end, _ := redis.Int(values[1], nil)
+			if slot < start || slot > end {
+				continue
+			}
+
+			master, err := redis.Values(values[2], nil)
+			if err != nil || len(master) < 2 {
+				return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply: %v", slotRange)
+			}
+
+			host, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if host == "" {
+				host = seed.Hostname()
+			}
+
+			address := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+			debug("slot %v of '%v' is served by %v", slot, key, address)
+			return redis.Dial("tcp", address, dialOptions(seedPassword(seed)...)...)
+		}
+
+		return nil, fmt.Errorf("no redis cluster node serves slot %v of '%v'", slot, key)
+	}
+}
+
+// checkMaster fails unless the connection is to a master
+func checkMaster(redisConn redis.Conn) error {
+	role, err := redis.Values(redisConn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	if len(role) == 0 {
+		return fmt.Errorf("empty ROLE reply")
+	}
+
+	name, err := redis.String(role[0], nil)
+	if err != nil {
+		return err
+	}
+
+	if name != "master" {
+		return fmt.Errorf("redis is a %v, not the master", name)
+	}
+	return nil
+}
+
+func seedPassword(seed *url.URL) []redis.DialOption {
+	if seed.User == nil {
+		return nil
+	}
+
+	password, ok := seed.User.Password()
+	if !ok {
+		return nil
+	}
+	return []redis.DialOption{redis.DialPassword(password)}
+}
+
+func dialOptions(options ...redis.DialOption) []redis.DialOption {
+	return append([]redis.DialOption{
+		redis.DialConnectTimeout(dialTimeout),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(writeTimeout),
+	}, options...)
+}
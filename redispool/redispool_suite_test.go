@@ -0,0 +1,13 @@
+package redispool_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRedispool(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Redispool Suite")
+}
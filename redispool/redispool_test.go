@@ -0,0 +1,167 @@
+package redispool_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/octoblu/governator/redispool"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("New", func() {
+	Describe("When the sentinel uri has no master name", func() {
+		It("Should return an error", func() {
+			_, err := redispool.New("redis-sentinel://127.0.0.1:26379", nil)
+			Expect(err).To(MatchError("Missing master name in 'redis-sentinel://127.0.0.1:26379'"))
+		})
+	})
+
+	Describe("When a sentinel uri is used with a redis cluster", func() {
+		It("Should return an error", func() {
+			_, err := redispool.New("redis-sentinel://127.0.0.1:26379/mymaster", &redispool.Options{ClusterKey: "{queue}"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	// the specs below start local redis-server processes
+	// and are skipped when there is no redis-server to start
+	Describe("With local redis servers", func() {
+		var servers []*exec.Cmd
+		var dir string
+
+		startRedis := func(args ...string) int {
+			port := getFreePort()
+			args = append(args, "--port", fmt.Sprintf("%d", port), "--dir", dir)
+			server := exec.Command("redis-server", args...)
+			Expect(server.Start()).To(Succeed())
+			servers = append(servers, server)
+
+			Eventually(func() error {
+				redisConn, err := redis.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				if err != nil {
+					return err
+				}
+				defer redisConn.Close()
+				_, err = redisConn.Do("PING")
+				return err
+			}, 5*time.Second).Should(Succeed())
+			return port
+		}
+
+		BeforeEach(func() {
+			if _, err := exec.LookPath("redis-server"); err != nil {
+				Skip("redis-server is not installed")
+			}
+
+			var err error
+			dir, err = ioutil.TempDir("", "redispool")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			for _, server := range servers {
+				server.Process.Kill()
+				server.Wait()
+			}
+			servers = nil
+			os.RemoveAll(dir)
+		})
+
+		Describe("When the uri is a sentinel uri", func() {
+			var pool *redis.Pool
+			var masterPort int
+
+			BeforeEach(func() {
+				masterPort = startRedis()
+				config := filepath.Join(dir, "sentinel.conf")
+				sentinelConfig := fmt.Sprintf("sentinel monitor mymaster 127.0.0.1 %d 1\n", masterPort)
+				Expect(ioutil.WriteFile(config, []byte(sentinelConfig), 0644)).To(Succeed())
+				sentinelPort := startRedis(config, "--sentinel")
+
+				var err error
+				pool, err = redispool.New(fmt.Sprintf("redis-sentinel://127.0.0.1:1,127.0.0.1:%d/mymaster", sentinelPort), nil)
+				Expect(err).To(BeNil())
+			})
+
+			It("Should connect to the master", func() {
+				redisConn := pool.Get()
+				defer redisConn.Close()
+
+				_, err := redisConn.Do("SET", "governator:test", "1")
+				Expect(err).To(BeNil())
+
+				port, err := redis.String(redisConn.Do("CONFIG", "GET", "port"))
+				Expect(err).To(BeNil())
+				Expect(port).To(Equal(fmt.Sprintf("%d", masterPort)))
+			})
+		})
+
+		Describe("When the master named by the sentinel uri is unknown", func() {
+			It("Should fail to connect", func() {
+				port := startRedis()
+				config := filepath.Join(dir, "sentinel.conf")
+				sentinelConfig := fmt.Sprintf("sentinel monitor mymaster 127.0.0.1 %d 1\n", port)
+				Expect(ioutil.WriteFile(config, []byte(sentinelConfig), 0644)).To(Succeed())
+				sentinelPort := startRedis(config, "--sentinel")
+
+				pool, err := redispool.New(fmt.Sprintf("redis-sentinel://127.0.0.1:%d/othermaster", sentinelPort), nil)
+				Expect(err).To(BeNil())
+
+				redisConn := pool.Get()
+				defer redisConn.Close()
+				_, err = redisConn.Do("PING")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("When a cluster key is given", func() {
+			var pool *redis.Pool
+
+			BeforeEach(func() {
+				port := startRedis("--cluster-enabled", "yes", "--cluster-config-file", filepath.Join(dir, "nodes.conf"))
+				redisConn, err := redis.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				Expect(err).To(BeNil())
+				defer redisConn.Close()
+
+				var slots []interface{}
+				for slot := 0; slot < 16384; slot++ {
+					slots = append(slots, slot)
+				}
+				_, err = redisConn.Do("CLUSTER", append([]interface{}{"ADDSLOTS"}, slots...)...)
+				Expect(err).To(BeNil())
+
+				Eventually(func() (string, error) {
+					return redis.String(redisConn.Do("CLUSTER", "INFO"))
+				}, 10*time.Second).Should(ContainSubstring("cluster_state:ok"))
+
+				pool, err = redispool.New(fmt.Sprintf("redis://127.0.0.1:%d", port), &redispool.Options{ClusterKey: "{queue}"})
+				Expect(err).To(BeNil())
+			})
+
+			It("Should connect to the node serving the key's slot", func() {
+				redisConn := pool.Get()
+				defer redisConn.Close()
+
+				_, err := redisConn.Do("ZADD", "{queue}:governator:deploys", 1, "deploy-1")
+				Expect(err).To(BeNil())
+				_, err = redisConn.Do("HSET", "{queue}:deploy-1", "status", "pending")
+				Expect(err).To(BeNil())
+			})
+		})
+	})
+})
+
+func getFreePort() int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,141 @@
+package redispool
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const sentinelScheme = "redis-sentinel://"
+
+// sentinelURI is a parsed redis-sentinel:// uri
+type sentinelURI struct {
+	addresses  []string
+	masterName string
+	password   string
+	database   int
+}
+
+func isSentinelURI(redisURI string) bool {
+	return strings.HasPrefix(redisURI, sentinelScheme)
+}
+
+// parseSentinelURI parses
+// redis-sentinel://[:password@]host:port[,host:port...]/master-name[/db],
+// net/url cannot be used because of the comma separated hosts
+func parseSentinelURI(redisURI string) (*sentinelURI, error) {
+	sentinel := &sentinelURI{}
+	rest := strings.TrimPrefix(redisURI, sentinelScheme)
+
+	if at := strings.LastIndex(rest, "@"); at != -1 {
+		userInfo := rest[:at]
+		rest = rest[at+1:]
+
+		if colon := strings.Index(userInfo, ":"); colon != -1 {
+			sentinel.password = userInfo[colon+1:]
+		}
+	}
+
+	parts := strings.Split(rest, "/")
+	for _, address := range strings.Split(parts[0], ",") {
+		if address == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "26379")
+		}
+		sentinel.addresses = append(sentinel.addresses, address)
+	}
+
+	if len(sentinel.addresses) == 0 {
+		return nil, fmt.Errorf("Missing sentinel address in '%v'", redisURI)
+	}
+
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Missing master name in '%v'", redisURI)
+	}
+	sentinel.masterName = parts[1]
+
+	if len(parts) > 2 && parts[2] != "" {
+		database, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid database in '%v'", redisURI)
+		}
+		sentinel.database = database
+	}
+
+	return sentinel, nil
+}
+
+// dialMaster asks the sentinels where the master is and connects to it
+func (sentinel *sentinelURI) dialMaster() (redis.Conn, error) {
+	address, err := sentinel.getMasterAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	options := []redis.DialOption{redis.DialDatabase(sentinel.database)}
+	if sentinel.password != "" {
+		options = append(options, redis.DialPassword(sentinel.password))
+	}
+
+	redisConn, err := redis.Dial("tcp", address, dialOptions(options...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sentinels may not have noticed a failover yet
+	err = checkMaster(redisConn)
+	if err != nil {
+		redisConn.Close()
+		return nil, err
+	}
+
+	return redisConn, nil
+}
+
+// getMasterAddress returns the address of the master
+// according to the first sentinel that answers
+func (sentinel *sentinelURI) getMasterAddress() (string, error) {
+	var lastErr error
+
+	for _, address := range sentinel.addresses {
+		masterAddress, err := sentinel.askSentinel(address)
+		if err != nil {
+			debug("sentinel %v: %v", address, err)
+			lastErr = err
+			continue
+		}
+
+		debug("master '%v' is at %v", sentinel.masterName, masterAddress)
+		return masterAddress, nil
+	}
+
+	return "", fmt.Errorf("No sentinel knows master '%v': %v", sentinel.masterName, lastErr)
+}
+
+func (sentinel *sentinelURI) askSentinel(address string) (string, error) {
+	sentinelConn, err := redis.Dial("tcp", address, dialOptions()...)
+	if err != nil {
+		return "", err
+	}
+	defer sentinelConn.Close()
+
+	reply, err := redis.Strings(sentinelConn.Do("SENTINEL", "get-master-addr-by-name", sentinel.masterName))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("unknown master '%v'", sentinel.masterName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
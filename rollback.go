@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	"github.com/octoblu/governator/deployer"
+)
+
+func rollbackCommand() cli.Command {
+	return cli.Command{
+		Name:      "rollback",
+		Usage:     "Roll an etcdDir back to an earlier release through the urgent lane",
+		ArgsUsage: "<etcdDir>",
+		Action:    rollback,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "to",
+				Usage: "Release, deploy or docker url to roll back to, defaults to the one before the current release",
+			},
+			cli.BoolFlag{
+				Name:  "emergency",
+				Usage: "Roll back outside the allowed deploy windows and blackouts of the schedule",
+			},
+		},
+	}
+}
+
+func releasesCommand() cli.Command {
+	return cli.Command{
+		Name:      "releases",
+		Usage:     "List the releases of an etcdDir, newest first",
+		ArgsUsage: "<etcdDir>",
+		Action:    listReleases,
+	}
+}
+
+func rollback(context *cli.Context) error {
+	etcdDir := getEtcdDirArg(context)
+	queue := getRedisQueue(context)
+
+	releases, err := queue.Releases(etcdDir)
+	if err != nil {
+		return err
+	}
+
+	// checked again when the rollback is claimed, this only fails early
+	dockerURL, err := deployer.FindRollbackTarget(releases, context.String("to"))
+	if err != nil {
+		return fmt.Errorf("Cannot roll %s back: %v", etcdDir, err)
+	}
+
+	now := time.Now()
+	// without a : so gc still tells the hash apart from those of other queues
+	service := strings.Replace(strings.Trim(etcdDir, "/"), "/", "-", -1)
+	deploy := fmt.Sprintf("rollback-%s-%d", strings.Replace(service, ":", "-", -1), now.Unix())
+	err = queue.EnqueueUrgent(deploy, now, &deployer.RequestMetadata{
+		EtcdDir:    etcdDir,
+		Type:       deployer.RequestTypeRollback,
+		RollbackTo: context.String("to"),
+		Emergency:  context.Bool("emergency"),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rolling %s back to %s as %s\n", etcdDir, dockerURL, deploy)
+	return nil
+}
+
+func listReleases(context *cli.Context) error {
+	releases, err := getRedisQueue(context).Releases(getEtcdDirArg(context))
+	if err != nil {
+		return err
+	}
+
+	for _, release := range releases {
+		deployedAt := time.Unix(release.DeployedAt, 0).UTC().Format(time.RFC3339)
+		kind := "deploy"
+		if release.Rollback {
+			kind = "rollback"
+		}
+		fmt.Printf("%s %s %s %s %s\n", deployedAt, release.Release, release.DockerURL, kind, release.Deploy)
+	}
+	return nil
+}
+
+func getEtcdDirArg(context *cli.Context) string {
+	etcdDir := context.Args().First()
+	if etcdDir == "" {
+		cli.ShowCommandHelp(context, context.Command.Name)
+		color.Red("  Missing required argument <etcdDir>")
+		os.Exit(1)
+	}
+	return etcdDir
+}
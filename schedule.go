@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/octoblu/governator/deployer"
+	"gopkg.in/yaml.v2"
+)
+
+// scheduleConfig is the file given to --schedule, like
+//
+//	timeZone: America/Phoenix
+//	allowed:
+//	  - "* 9-16 * * mon-thu"
+//	  - "* 9-11 * * fri"
+//	blackouts:
+//	  - from: 2026-11-26 00:00
+//	    to: 2026-11-30 00:00
+//	    reason: thanksgiving traffic
+type scheduleConfig struct {
+	TimeZone  string           `yaml:"timeZone"`
+	Allowed   []string         `yaml:"allowed"`
+	Blackouts []blackoutConfig `yaml:"blackouts"`
+}
+
+type blackoutConfig struct {
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+	Reason string `yaml:"reason"`
+}
+
+// loadSchedule reads the schedule deploys have to keep to
+func loadSchedule(schedulePath string) (*deployer.Schedule, error) {
+	scheduleBytes, err := ioutil.ReadFile(schedulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var theConfig scheduleConfig
+	err = yaml.Unmarshal(scheduleBytes, &theConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var blackouts []deployer.Blackout
+	for _, blackout := range theConfig.Blackouts {
+		blackouts = append(blackouts, deployer.Blackout{From: blackout.From, To: blackout.To, Reason: blackout.Reason})
+	}
+
+	return deployer.NewSchedule(theConfig.TimeZone, theConfig.Allowed, blackouts)
+}